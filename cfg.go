@@ -6,12 +6,23 @@ package cfg
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Quotation specifies the output quoting mode
@@ -24,15 +35,45 @@ const (
 	Single
 )
 
-const (
-	commitSize = 100 // Number of attributes to buffer.
-)
-
 var (
 	// Chatty controls verbose parser output.
 	Chatty = false
+	// Strict controls whether questionable input is an error rather than discarded
+	Strict = false
 	// Quoting controls how attributes are quoted
 	Quoting = Double
+	// Validator, if set, is called on every cfg loaded and its error is returned by Load
+	Validator func(Cfg) error
+	// KeyByPrimaryValue keys tuples and records by the value of their first attribute rather than its name
+	KeyByPrimaryValue = false
+	// LineEnding terminates each emitted tuple
+	LineEnding = "\n"
+	// AllowBackticks emits values containing quotes as backtick raw values, Load takes them literally while set
+	AllowBackticks = false
+	// SortAttributes emits each tuple's attributes sorted by name around its primary key, which keeps its position
+	SortAttributes = false
+	// FinalNewline controls whether emitted output ends in a LineEnding
+	FinalNewline = KeepNewline
+	// OmitEmptyEquals emits attributes with empty values as just their name, unless marked QuotedEmpty
+	OmitEmptyEquals = false
+	// EscapeControl emits control characters and backslashes in values as \xNN escapes, Load decodes them while set
+	EscapeControl = false
+	// Base64Names lists names whose values are emitted base64-encoded, without padding, Load decodes them while set
+	Base64Names []string
+	// PrimaryKeyIndex is the index of the attribute keying a tuple, tuples too short for it fall back to the first attribute
+	PrimaryKeyIndex = 0
+)
+
+// NewlinePolicy specifies how Emit treats the end of its output
+type NewlinePolicy int
+
+const (
+	// KeepNewline emits output as-is, ending in a newline unless the cfg is empty
+	KeepNewline NewlinePolicy = iota
+	// ForceNewline guarantees output ends in a newline, even if the cfg is empty
+	ForceNewline
+	// StripNewline guarantees output does not end in a newline
+	StripNewline
 )
 
 // States that the parser  can be in at a given time.
@@ -46,6 +87,7 @@ const (
 	dquotebegin               // In a "bar"
 	squoteend                 // Closed a 'foo'
 	dquoteend                 // Closed a "bar"
+	rawend                    // Closed a `baz`
 )
 
 // Attributes is a set of attributes.
@@ -60,19 +102,57 @@ type Records []*Record
 // Cfg is a data structure representation of a cfg(2) file.
 type Cfg struct {
 	Records
-	Map map[string]map[string]map[string][]string // Maps record's primary key to tuple primary keys to attribute maps
+	Map map[string]map[string]map[string][]string // Maps record's primary key to tuple primary keys to attribute maps, read through Maps after edits
+
+	dirty   bool                 // Map is stale and must be rebuilt
+	index   map[string][]*Record // Records by primary key for Lookup, nil if stale
+	indexed indexState           // Record count and keying the index was built from
+}
+
+// Record count and keying globals an index was built from, so that it can tell when it is stale
+type indexState struct {
+	records  int
+	byValue  bool
+	keyIndex int
 }
 
 // Attribute is a name and optional value pair.
 type Attribute struct {
-	Name  string // Mandatory
-	Value string // Optional
+	Name        string // Mandatory
+	Value       string // Optional
+	QuotedEmpty bool   // Value is explicitly an empty quoted string
+	Assigned    bool   // Name was followed by '=' when loaded, so an empty Value was given rather than omitted
+	Raw         string // Source text of the attribute if loaded with Options.KeepRaw, emitted as-is until the attribute is edited
+	Comment     string // Trailing comment on the line, emitted after the tuple
+
+	Meta map[string]string // In-memory annotations, never loaded or emitted
+
+	raw       rawAttr // Attribute as Raw was loaded, to detect edits
+	sep       string  // Whitespace following Raw in the source line
+	line, col uint64  // Source line and rune of the attribute when loaded, 0 if unknown
+}
+
+// Fields of an attribute which Raw encodes
+type rawAttr struct {
+	name, value string
+	quotedEmpty bool
+}
+
+// TypedAttribute is a name and a value inferred to be an int64, float64, bool, or string.
+// Valueless attributes have a nil Value.
+type TypedAttribute struct {
+	Name  string
+	Value interface{}
 }
 
 // Tuple represents a set of attributes which contain names and optional value pairs.
 type Tuple struct {
 	Attributes
-	Map map[string][]string // Maps attribute names to all values	(Generated)
+	Map   map[string][]string // Maps attribute names to all values	(Generated)
+	Depth int                 // Length of the leading whitespace in the source line
+	Split string              // Separator joining the primary key to each other name when emitted
+
+	indent string // Leading whitespace in the source line if loaded with Options.KeepRaw
 }
 
 // Record represents a set of tuples which contain attributes.
@@ -81,6 +161,28 @@ type Record struct {
 	Map map[string]map[string][]string // Maps tuple's primary key to attribute map
 }
 
+// Filter returns the attributes for which 'keep' returns true.
+func (as Attributes) Filter(keep func(*Attribute) bool) Attributes {
+	var out Attributes
+
+	for _, a := range as {
+		if keep(a) {
+			out = append(out, a)
+		}
+	}
+
+	return out
+}
+
+// SetMeta sets the in-memory annotation 'k' to 'v'.
+func (a *Attribute) SetMeta(k, v string) {
+	if a.Meta == nil {
+		a.Meta = make(map[string]string)
+	}
+
+	a.Meta[k] = v
+}
+
 // Lookup returns the attributes whose name matches 'name'.
 func (t *Tuple) Lookup(name string) ([]*Attribute, bool) {
 	var out []*Attribute
@@ -94,9 +196,120 @@ func (t *Tuple) Lookup(name string) ([]*Attribute, bool) {
 	return out, len(out) > 0
 }
 
-// PrimaryKey returns the first name of the first attribute of a tuple.
+// PrimaryKey returns the name of the primary attribute of a tuple, the first unless PrimaryKeyIndex is set.
+// If KeyByPrimaryValue is set and the primary attribute has a value, the value is returned instead.
 func (t Tuple) PrimaryKey() string {
-	return t.Attributes[0].Name
+	first := t.primary()
+	if KeyByPrimaryValue && first.Value != "" {
+		return first.Value
+	}
+
+	return first.Name
+}
+
+// The attribute at PrimaryKeyIndex, or the first if out of range
+func (t Tuple) primary() *Attribute {
+	if PrimaryKeyIndex > 0 && PrimaryKeyIndex < len(t.Attributes) {
+		return t.Attributes[PrimaryKeyIndex]
+	}
+
+	return t.Attributes[0]
+}
+
+// SetAttributes replaces the tuple's attributes and rebuilds its map.
+func (t *Tuple) SetAttributes(attrs Attributes) {
+	t.Attributes = attrs
+	t.Map = t.BuildMap()
+}
+
+// AppendAll appends copies of 'attrs' to the tuple and then rebuilds its map once.
+func (t *Tuple) AppendAll(attrs ...Attribute) {
+	for i := range attrs {
+		a := attrs[i]
+		t.Attributes = append(t.Attributes, &a)
+	}
+
+	t.Map = t.BuildMap()
+}
+
+// Each calls 'fn' with the index of and a pointer to each of the tuple's attributes in order.
+// Edits through the pointer apply in place, call Rebuild afterwards to update the tuple's map.
+func (t *Tuple) Each(fn func(i int, a *Attribute)) {
+	for i, a := range t.Attributes {
+		fn(i, a)
+	}
+}
+
+// Rebuild rebuilds the tuple's map from its attributes.
+func (t *Tuple) Rebuild() {
+	t.Map = t.BuildMap()
+}
+
+// GetLast returns the value of the last attribute named 'name'.
+func (t *Tuple) GetLast(name string) (string, bool) {
+	for i := len(t.Attributes) - 1; i >= 0; i-- {
+		if a := t.Attributes[i]; a.Name == name {
+			return a.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Typed returns the tuple's attributes with their values inferred as ints, floats, bools, or strings.
+// Only unambiguous values are converted: decimal integers without leading zeros, decimal floats, and true or false.
+func (t *Tuple) Typed() []TypedAttribute {
+	var out []TypedAttribute
+
+	for _, a := range t.Attributes {
+		out = append(out, TypedAttribute{a.Name, infer(a.Value)})
+	}
+
+	return out
+}
+
+// Infer the type of a value conservatively
+func infer(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	digits := strings.TrimPrefix(s, "-")
+	whole, frac, isFloat := strings.Cut(digits, ".")
+	if whole == "" || (len(whole) > 1 && whole[0] == '0') || strings.IndexFunc(whole+frac, func(r rune) bool {
+		return r < '0' || r > '9'
+	}) >= 0 {
+		return s
+	}
+
+	if !isFloat {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+		return s
+	}
+
+	if frac == "" {
+		return s
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+
+	return s
+}
+
+// PrimaryValue returns the value of the primary attribute of a tuple.
+func (t Tuple) PrimaryValue() string {
+	return t.primary().Value
 }
 
 // BuildMap builds a map[string]string representation of an Attribute set.
@@ -128,11 +341,95 @@ func (r *Record) Lookup(name string) ([]*Tuple, bool) {
 	return out, len(out) > 0
 }
 
-// PrimaryKey returns the first name of the first attribute of the first tuple of a record.
+// PrimaryKey returns the name of the primary attribute of the first tuple of a record, the first unless PrimaryKeyIndex is set.
+// If KeyByPrimaryValue is set and the primary attribute has a value, the value is returned instead.
 func (r Record) PrimaryKey() string {
 	return r.Tuples[0].PrimaryKey()
 }
 
+// Head returns the first tuple of a record, which holds its primary key, or nil for an empty record.
+func (r *Record) Head() *Tuple {
+	if len(r.Tuples) < 1 {
+		return nil
+	}
+
+	return r.Tuples[0]
+}
+
+// Body returns the tuples of a record following its head.
+func (r *Record) Body() Tuples {
+	if len(r.Tuples) < 2 {
+		return nil
+	}
+
+	return r.Tuples[1:]
+}
+
+// Timestamp returns the time in the ts attribute of a record's head tuple, as added by AppendRecordWithTimestamp.
+func (r *Record) Timestamp() (time.Time, bool) {
+	h := r.Head()
+	if h == nil {
+		return time.Time{}, false
+	}
+
+	v, ok := h.GetLast("ts")
+	if !ok {
+		return time.Time{}, false
+	}
+
+	ts, err := time.Parse(time.RFC3339, v)
+	return ts, err == nil
+}
+
+// Split returns a standalone single-tuple record for each of the record's tuples, in order.
+// The head tuple is copied as-is and the record's primary attribute is copied into every other tuple at PrimaryKeyIndex,
+// or to the front of tuples too short for it, so each record keeps the original primary key.
+func (r *Record) Split() []*Record {
+	var out []*Record
+
+	for i, t := range r.Tuples {
+		t = t.Clone()
+		if i > 0 && len(r.Tuples[0].Attributes) > 0 {
+			primary := *r.Tuples[0].primary()
+			primary.Comment = ""
+			primary.Meta = nil
+
+			pos := PrimaryKeyIndex
+			if pos < 0 || pos > len(t.Attributes) {
+				pos = 0
+			}
+			attrs := append(append(Attributes{}, t.Attributes[:pos]...), &primary)
+			t.SetAttributes(append(attrs, t.Attributes[pos:]...))
+		}
+		t.Depth = 0
+
+		rec := &Record{Tuples: Tuples{t}}
+		rec.Map = rec.BuildMap()
+		out = append(out, rec)
+	}
+
+	return out
+}
+
+// Attributes returns the attributes of a record's head tuple, or nil for an empty record.
+func (r *Record) Attributes() Attributes {
+	if h := r.Head(); h != nil {
+		return h.Attributes
+	}
+
+	return nil
+}
+
+// PrimaryValue returns the value of the primary attribute of the first tuple of a record, the first unless PrimaryKeyIndex is set.
+func (r Record) PrimaryValue() string {
+	return r.Tuples[0].PrimaryValue()
+}
+
+// HasKeyedValue reports whether the record's primary key attribute carries a value, as in sys=web01.
+func (r Record) HasKeyedValue() bool {
+	return r.PrimaryValue() != ""
+}
+
 // BuildMap returns a mapping of tuple primary keys to the tuple's attribute map.
 func (r Record) BuildMap() map[string]map[string][]string {
 	out := make(map[string]map[string][]string)
@@ -145,6 +442,90 @@ func (r Record) BuildMap() map[string]map[string][]string {
 	return out
 }
 
+// GetLast returns the value of the last attribute named 'name' across the record's tuples.
+func (r *Record) GetLast(name string) (string, bool) {
+	for i := len(r.Tuples) - 1; i >= 0; i-- {
+		if v, ok := r.Tuples[i].GetLast(name); ok {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// CollectIndexed returns the values of attributes named as 'prefix'.N across the record, ordered by the integer N.
+// Gaps in the indices are skipped, and only the first value of a repeated index is used.
+func (r *Record) CollectIndexed(prefix string) []string {
+	byIndex := make(map[int]string)
+
+	for _, t := range r.Tuples {
+		for _, a := range t.Attributes {
+			suffix := strings.TrimPrefix(a.Name, prefix+".")
+			if suffix == a.Name {
+				continue
+			}
+
+			n, err := strconv.Atoi(suffix)
+			if err != nil || n < 0 {
+				continue
+			}
+
+			if _, ok := byIndex[n]; !ok {
+				byIndex[n] = a.Value
+			}
+		}
+	}
+
+	var indices []int
+	for n := range byIndex {
+		indices = append(indices, n)
+	}
+	sort.Ints(indices)
+
+	var out []string
+	for _, n := range indices {
+		out = append(out, byIndex[n])
+	}
+
+	return out
+}
+
+// FindTuple returns the first tuple in the record containing the attribute name=value.
+func (r *Record) FindTuple(name, value string) (*Tuple, bool) {
+	for _, t := range r.Tuples {
+		attrs, _ := t.Lookup(name)
+		for _, a := range attrs {
+			if a.Value == value {
+				return t, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// SetAll sets the value of every attribute named 'name' in the record to 'value'.
+// No attributes are added. Returns the number of attributes changed.
+func (r *Record) SetAll(name, value string) int {
+	n := 0
+
+	for _, t := range r.Tuples {
+		attrs, ok := t.Lookup(name)
+		if !ok {
+			continue
+		}
+
+		for _, a := range attrs {
+			a.Value = value
+			n++
+		}
+		t.Map = t.BuildMap()
+	}
+
+	r.Map = r.BuildMap()
+	return n
+}
+
 // FlatMap returns a map which is the union of all the record's tuples' maps.
 // Only the first instance of a name is inserted.
 func (r Record) FlatMap() map[string]string {
@@ -168,8 +549,54 @@ func (r Record) FlatMap() map[string]string {
 	return out
 }
 
+// FlatMapStrict is FlatMap, but returns an error if a name has differing values across the record.
+// Repeats of the same value are not a conflict.
+func (r Record) FlatMapStrict() (map[string]string, error) {
+	out := r.FlatMap()
+
+	for n, vs := range attrValues(r.Tuples) {
+		for _, v := range vs {
+			if v != out[n] {
+				return nil, fmt.Errorf("conflicting values %s and %s for name %s", Quote(out[n]), Quote(v), Quote(n))
+			}
+		}
+	}
+
+	return out, nil
+}
+
 // Lookup returns cfg records whose primary key matches 'name'.
+// Lookups use an index built on first use, which is rebuilt if the number of records, KeyByPrimaryValue, or PrimaryKeyIndex change,
+// or after BuildMap and Invalidate, which the cfg's mutators call.
+// Call Invalidate after replacing a record or changing its primary key in place.
 func (c *Cfg) Lookup(name string) ([]*Record, bool) {
+	c.Index()
+
+	out := c.index[name]
+	return out[:len(out):len(out)], len(out) > 0
+}
+
+// Index builds the index used by Lookup if it is stale or has never been built.
+func (c *Cfg) Index() {
+	if c.index != nil && c.indexed.current(len(c.Records)) {
+		return
+	}
+
+	c.index = make(map[string][]*Record)
+	for _, r := range c.Records {
+		k := r.PrimaryKey()
+		c.index[k] = append(c.index[k], r)
+	}
+	c.indexed = indexState{len(c.Records), KeyByPrimaryValue, PrimaryKeyIndex}
+}
+
+// Whether an index built from 's' still matches 'n' records and the keying globals
+func (s indexState) current(n int) bool {
+	return s.records == n && s.byValue == KeyByPrimaryValue && s.keyIndex == PrimaryKeyIndex
+}
+
+// Records whose primary key matches 'name', without the index
+func (c *Cfg) lookup(name string) []*Record {
 	var out []*Record
 
 	for _, r := range c.Records {
@@ -178,391 +605,2011 @@ func (c *Cfg) Lookup(name string) ([]*Record, bool) {
 		}
 	}
 
-	return out, len(out) > 0
+	return out
 }
 
-// Keys returns the Record primary keys for a cfg.
-func (c *Cfg) Keys() []string {
-	var out []string
+// LookupInt returns cfg records whose primary key is an integer equal to 'key', so 007 matches 7.
+func (c *Cfg) LookupInt(key int64) ([]*Record, bool) {
+	var out []*Record
 
 	for _, r := range c.Records {
-		out = append(out, r.PrimaryKey())
+		if n, err := strconv.ParseInt(r.PrimaryKey(), 10, 64); err == nil && n == key {
+			out = append(out, r)
+		}
 	}
 
-	return out
+	return out, len(out) > 0
 }
 
-// FlatMap returns a map which is the union of all the cfg's records' tuples' maps.
-// Only the first instance of a name is inserted.
-func (c Cfg) FlatMap() map[string]string {
-	out := make(map[string]string)
+// LookupLast returns the last cfg record whose primary key matches 'name'.
+func (c *Cfg) LookupLast(name string) (*Record, bool) {
+	for i := len(c.Records) - 1; i >= 0; i-- {
+		if r := c.Records[i]; r.PrimaryKey() == name {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+// Match is an attribute found in a cfg along with the tuple and record containing it.
+type Match struct {
+	Record    *Record
+	Tuple     *Tuple
+	Attribute *Attribute
+}
+
+// MissingValues returns every attribute named in 'names' which was given an empty value, as in name= or name="".
+// Valueless flags written without '=' are not reported.
+func (c *Cfg) MissingValues(names ...string) []Match {
+	wanted := make(map[string]bool)
+	for _, n := range names {
+		wanted[n] = true
+	}
+
+	var out []Match
 	for _, r := range c.Records {
 		for _, t := range r.Tuples {
-			for n, v := range t.BuildMap() {
-				if _, ok := out[n]; ok {
-					// This entry exists
-					continue
-				}
-
-				if len(v) > 0 {
-					// Take first value
-					out[n] = v[0]
-				} else {
-					// No list, so this is empty string
-					out[n] = ""
+			for _, a := range t.Attributes {
+				if wanted[a.Name] && a.Value == "" && (a.Assigned || a.QuotedEmpty) {
+					out = append(out, Match{Record: r, Tuple: t, Attribute: a})
 				}
 			}
 		}
 	}
+
 	return out
 }
 
-// BuildMap returns a map mapping record primary keys to tuple primary keys to attribute maps.
-func (c *Cfg) BuildMap() map[string]map[string]map[string][]string {
-	out := make(map[string]map[string]map[string][]string)
+// MissingAttribute returns the records none of whose tuples have an attribute named 'name'.
+func (c *Cfg) MissingAttribute(name string) Records {
+	var out Records
 
+records:
 	for _, r := range c.Records {
-		out[r.PrimaryKey()] = r.BuildMap()
+		for _, t := range r.Tuples {
+			if _, ok := t.Lookup(name); ok {
+				continue records
+			}
+		}
+
+		out = append(out, r)
 	}
 
-	c.Map = out
 	return out
 }
 
-// Load parses a cfg file and returns a complete cfg.
-func Load(r io.Reader) (Cfg, error) {
-	c := Cfg{}
-	br := bufio.NewReader(r)
-	var ln, rn uint64
-
-lines:
-	for ln = 1; ; ln++ {
-		line, err := br.ReadString('\n')
-		if err == io.EOF {
-			break lines
-		}
-		if err != nil {
-			return c, err
-		}
+// Blame returns every attribute of the cfg in document order with its record's primary key and source position.
+// Line and Col, the rune within the line, are 1-based, and 0 for attributes not loaded from a source.
+// Positions come from the scanner, so Col is where the attribute's text begins, including any opening quote.
+func (c *Cfg) Blame() []struct {
+	Record, Name, Value string
+	Line, Col           uint64
+} {
+	var out []struct {
+		Record, Name, Value string
+		Line, Col           uint64
+	}
 
-		// Trim comments
-		ci := strings.IndexFunc(line, func(r rune) bool {
-			return r == '#'
-		})
-		if ci >= 0 {
-			line = line[:ci]
+	for _, r := range c.Records {
+		k := r.PrimaryKey()
+		for _, t := range r.Tuples {
+			for _, a := range t.Attributes {
+				out = append(out, struct {
+					Record, Name, Value string
+					Line, Col           uint64
+				}{k, a.Name, a.Value, a.line, a.col})
+			}
 		}
+	}
 
-		// Whitespace beginning index and first 'letter' index
-		wi := strings.IndexFunc(line, unicode.IsSpace)
-		li := strings.IndexFunc(line, func(r rune) bool {
-			return !unicode.IsSpace(r)
-		})
-
-		in := false
-
-		if wi < li {
-			// Leading whitespace, Tuple is a part of a record
-			chat("tuple in record →", line)
-			in = true
+	return out
+}
 
-		} else if (wi < 0 || wi > li) && li >= 0 {
-			// No leading whitespace, start a new record
-			chat("new record →", line)
-			in = false
+// Shadowed returns the records absent from the cfg's Map because a later record has the same primary key.
+func (c *Cfg) Shadowed() []*Record {
+	last := make(map[string]*Record)
+	for _, r := range c.Records {
+		last[r.PrimaryKey()] = r
+	}
 
-		} else {
-			// Empty line
-			chat("empty →", line)
-			continue lines
+	var out []*Record
+	for _, r := range c.Records {
+		if last[r.PrimaryKey()] != r {
+			out = append(out, r)
 		}
+	}
 
-		done := make(chan *Tuple)
-		commit := make(chan *Attribute, commitSize)
-		go func() {
-			tuple := &Tuple{[]*Attribute{}, make(map[string][]string)}
-			for {
-				a, ok := <-commit
-				if !ok {
-					break
-				}
+	return out
+}
 
-				// Discard empty attributes (usually a bug)
-				if a.Name == "" && a.Value == "" {
-					continue
-				}
+// Keys returns the Record primary keys for a cfg.
+func (c *Cfg) Keys() []string {
+	var out []string
 
-				// Insert attribute
-				tuple.Attributes = append(tuple.Attributes, a)
-			}
-			done <- tuple
-		}()
+	for _, r := range c.Records {
+		out = append(out, r.PrimaryKey())
+	}
 
-		// Parse line
-		state := name
-		lr := strings.NewReader(line)
+	return out
+}
 
-		n := ""
-		v := ""
-		var word strings.Builder
-	scan:
-		for rn = 1; lr.Len() > 0; rn++ {
-			r, _, err := lr.ReadRune()
+// Entries returns each record of a cfg paired with its primary key, in order.
+func (c *Cfg) Entries() []struct {
+	Key    string
+	Record *Record
+} {
+	var out []struct {
+		Key    string
+		Record *Record
+	}
+
+	for _, r := range c.Records {
+		out = append(out, struct {
+			Key    string
+			Record *Record
+		}{r.PrimaryKey(), r})
+	}
+
+	return out
+}
+
+// Primaries returns the primary attribute of each record for a cfg.
+func (c *Cfg) Primaries() Attributes {
+	var out Attributes
+
+	for _, r := range c.Records {
+		out = append(out, r.Tuples[0].primary())
+	}
+
+	return out
+}
+
+// SelectTuples returns every tuple in the cfg for which 'pred' returns true.
+func (c *Cfg) SelectTuples(pred func(*Tuple) bool) Tuples {
+	var out Tuples
+
+	for _, r := range c.Records {
+		for _, t := range r.Tuples {
+			if pred(t) {
+				out = append(out, t)
+			}
+		}
+	}
+
+	return out
+}
+
+// DistinctValues returns the sorted unique values of attributes named 'name' anywhere in the cfg.
+func (c *Cfg) DistinctValues(name string) []string {
+	seen := make(map[string]bool)
+	var out []string
+
+	for _, r := range c.Records {
+		for _, t := range r.Tuples {
+			for _, a := range t.Attributes {
+				if a.Name != name || a.Value == "" || seen[a.Value] {
+					continue
+				}
+
+				seen[a.Value] = true
+				out = append(out, a.Value)
+			}
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// Select returns a cfg of only the records whose primary key is one of 'keys', in their original order.
+func (c Cfg) Select(keys ...string) Cfg {
+	want := make(map[string]bool)
+	for _, k := range keys {
+		want[k] = true
+	}
+
+	out := Cfg{}
+	for _, r := range c.Records {
+		if want[r.PrimaryKey()] {
+			out.Records = append(out.Records, r)
+		}
+	}
+
+	out.BuildMap()
+	return out
+}
+
+// ReorderLike reorders the cfg's records to follow the primary key order of 'reference'.
+// Records whose key is not in 'reference' follow in their original order.
+func (c *Cfg) ReorderLike(reference *Cfg) {
+	c.Records = c.ordered(reference.Keys())
+	c.changed()
+}
+
+// Records ordered by primary key per 'keys', followed by unlisted records in their original order
+func (c *Cfg) ordered(keys []string) Records {
+	var out Records
+	placed := make(map[string]bool)
+
+	for _, k := range keys {
+		if placed[k] {
+			continue
+		}
+		placed[k] = true
+
+		records, _ := c.Lookup(k)
+		out = append(out, records...)
+	}
+
+	for _, r := range c.Records {
+		if !placed[r.PrimaryKey()] {
+			out = append(out, r)
+		}
+	}
+
+	return out
+}
+
+// MoveTuple moves the tuple at 'tupleIndex' of the first record keyed as 'fromKey' to the end of the first record keyed as 'toKey'.
+// The first tuple of a record holds its primary key and can't be moved.
+func (c *Cfg) MoveTuple(fromKey string, tupleIndex int, toKey string) error {
+	from, ok := c.Lookup(fromKey)
+	if !ok {
+		return errors.New("no record keyed as " + fromKey)
+	}
+
+	to, ok := c.Lookup(toKey)
+	if !ok {
+		return errors.New("no record keyed as " + toKey)
+	}
+
+	src := from[0]
+	if tupleIndex < 1 || tupleIndex >= len(src.Tuples) {
+		return fmt.Errorf("tuple index %d out of range for record %s with %d tuples", tupleIndex, fromKey, len(src.Tuples))
+	}
+
+	t := src.Tuples[tupleIndex]
+	src.Tuples = append(src.Tuples[:tupleIndex:tupleIndex], src.Tuples[tupleIndex+1:]...)
+	to[0].Tuples = append(to[0].Tuples, t)
+
+	c.changed()
+	return nil
+}
+
+// RecordOf returns the record containing the tuple 't', compared by pointer.
+func (c *Cfg) RecordOf(t *Tuple) (*Record, bool) {
+	for _, r := range c.Records {
+		for _, rt := range r.Tuples {
+			if rt == t {
+				return r, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// LayeredCfg is a cfg whose lookups fall back to a cfg of defaults.
+type LayeredCfg struct {
+	Cfg      *Cfg
+	Defaults *Cfg
+}
+
+// RewriteValues replaces matches of 're' in every attribute value with 'repl', as by re.ReplaceAllString.
+// Names are untouched. Returns the number of attributes changed.
+func (c *Cfg) RewriteValues(re *regexp.Regexp, repl string) int {
+	n := 0
+
+	for _, r := range c.Records {
+		changed := false
+		for _, t := range r.Tuples {
+			tn := n
+			for _, a := range t.Attributes {
+				if v := re.ReplaceAllString(a.Value, repl); v != a.Value {
+					a.Value = v
+					n++
+				}
+			}
+
+			if n > tn {
+				t.Map = t.BuildMap()
+				changed = true
+			}
+		}
+
+		if changed {
+			r.Map = r.BuildMap()
+		}
+	}
+
+	c.changed()
+	return n
+}
+
+// AppendRecordWithTimestamp appends 'r' to the cfg with a ts attribute holding 'ts' in RFC 3339 format.
+// The ts attribute is inserted after the primary key of the record's head tuple, or keys the record if its head is empty.
+func (c *Cfg) AppendRecordWithTimestamp(r *Record, ts time.Time) {
+	a := &Attribute{Name: "ts", Value: ts.Format(time.RFC3339)}
+
+	switch h := r.Head(); {
+	case h == nil:
+		r.Tuples = Tuples{{Attributes: Attributes{a}}}
+	case len(h.Attributes) < 1:
+		h.SetAttributes(Attributes{a})
+	default:
+		attrs := append(Attributes{h.Attributes[0], a}, h.Attributes[1:]...)
+		h.SetAttributes(attrs)
+	}
+
+	r.Map = r.BuildMap()
+	c.Records = append(c.Records, r)
+	c.changed()
+}
+
+// PruneEmpty removes empty records and returns the number removed.
+// A record is empty if its only attribute is a valueless primary key, its other tuples having no attributes.
+// A primary key holding an explicitly quoted empty value is not valueless.
+func (c *Cfg) PruneEmpty() int {
+	var kept Records
+
+	for _, r := range c.Records {
+		var attrs Attributes
+		for _, t := range r.Tuples {
+			attrs = append(attrs, t.Attributes...)
+		}
+
+		if len(attrs) > 1 || (len(attrs) == 1 && (attrs[0].Value != "" || attrs[0].QuotedEmpty)) {
+			kept = append(kept, r)
+		}
+	}
+
+	n := len(c.Records) - len(kept)
+	c.Records = kept
+	c.changed()
+
+	return n
+}
+
+// MergeDuplicates combines records sharing a primary key into the first of them, appending later records' tuples in order.
+// Afterwards the cfg has one record per key, matching Maps.
+func (c *Cfg) MergeDuplicates() {
+	first := make(map[string]*Record)
+	var kept Records
+
+	for _, r := range c.Records {
+		k := r.PrimaryKey()
+		if f, ok := first[k]; ok {
+			f.Tuples = append(f.Tuples, r.Tuples...)
+			continue
+		}
+
+		first[k] = r
+		kept = append(kept, r)
+	}
+
+	for _, r := range kept {
+		r.Map = r.BuildMap()
+	}
+
+	c.Records = kept
+	c.changed()
+}
+
+// NormalizeValueless clears QuotedEmpty from every attribute so all valueless attributes are emitted alike.
+// They are then emitted as name= or, if OmitEmptyEquals is set, as just their name.
+func (c *Cfg) NormalizeValueless() {
+	for _, r := range c.Records {
+		for _, t := range r.Tuples {
+			for _, a := range t.Attributes {
+				if a.Value == "" {
+					a.QuotedEmpty = false
+				}
+			}
+		}
+	}
+	c.changed()
+}
+
+// WithDefaults returns a view of the cfg which falls back to 'defaults' for missing attributes.
+func (c *Cfg) WithDefaults(defaults *Cfg) *LayeredCfg {
+	return &LayeredCfg{c, defaults}
+}
+
+// Get returns the first value of the attribute 'attr' in the first record keyed as 'record'.
+// The cfg is consulted before the defaults.
+func (l *LayeredCfg) Get(record, attr string) (string, bool) {
+	for _, c := range []*Cfg{l.Cfg, l.Defaults} {
+		if c == nil {
+			continue
+		}
+
+		records, ok := c.Lookup(record)
+		if !ok {
+			continue
+		}
+
+		if v, ok := records[0].FlatMap()[attr]; ok {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// UniformSchema reports whether every record has the same set of attribute names.
+// The sorted union of all attribute names in the cfg is also returned.
+func (c *Cfg) UniformSchema() (bool, []string) {
+	uniform := true
+	union := make(map[string]bool)
+	var first map[string]string
+
+	for i, r := range c.Records {
+		names := r.FlatMap()
+		for n := range names {
+			union[n] = true
+		}
+
+		if i == 0 {
+			first = names
+			continue
+		}
+
+		if len(names) != len(first) {
+			uniform = false
+			continue
+		}
+
+		for n := range names {
+			if _, ok := first[n]; !ok {
+				uniform = false
+				break
+			}
+		}
+	}
+
+	var out []string
+	for n := range union {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+
+	return uniform, out
+}
+
+// NameUnion returns the sorted union of attribute names across all records whose primary key matches 'recordKey'.
+func (c *Cfg) NameUnion(recordKey string) []string {
+	union := make(map[string]bool)
+	records, _ := c.Lookup(recordKey)
+
+	for _, r := range records {
+		for _, t := range r.Tuples {
+			for _, a := range t.Attributes {
+				union[a.Name] = true
+			}
+		}
+	}
+
+	var out []string
+	for n := range union {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// Generic returns the cfg as nested maps for consumers of generic data, such as templates.
+// Each record primary key maps to the attributes of the record's head tuple,
+// and within that each following tuple's primary key maps to the tuple's own attributes.
+// Names with a single value map to a string, repeated names to a []string, and valueless names to "".
+// Records, or tuples within a record, sharing a primary key are collected into a []interface{} of their maps.
+func (c Cfg) Generic() map[string]interface{} {
+	out := make(map[string]interface{})
+
+	for _, r := range c.Records {
+		if len(r.Tuples) < 1 {
+			continue
+		}
+
+		m := genericAttrs(r.Tuples[:1])
+		for _, t := range r.Tuples[1:] {
+			if len(t.Attributes) > 0 {
+				collect(m, t.PrimaryKey(), genericAttrs(Tuples{t}))
+			}
+		}
+
+		collect(out, r.PrimaryKey(), m)
+	}
+
+	return out
+}
+
+// Attributes of 'tuples' as a generic map
+func genericAttrs(tuples Tuples) map[string]interface{} {
+	m := make(map[string]interface{})
+
+	for n, vs := range attrValues(tuples) {
+		switch len(vs) {
+		case 0:
+			m[n] = ""
+		case 1:
+			m[n] = vs[0]
+		default:
+			m[n] = vs
+		}
+	}
+
+	return m
+}
+
+// Add 'v' to 'm' at 'k', collecting it into a []interface{} with any value already there
+func collect(m map[string]interface{}, k string, v interface{}) {
+	switch prev := m[k].(type) {
+	case nil:
+		m[k] = v
+	case []interface{}:
+		m[k] = append(prev, v)
+	default:
+		m[k] = []interface{}{prev, v}
+	}
+}
+
+// Partition groups records by the first value of their attribute 'name' into standalone cfgs.
+// Records without a value for 'name' are grouped under "".
+func (c *Cfg) Partition(name string) map[string]Cfg {
+	out := make(map[string]Cfg)
+
+	for _, r := range c.Records {
+		v := r.FlatMap()[name]
+		part := out[v]
+		part.Records = append(part.Records, r)
+		out[v] = part
+	}
+
+	for v, part := range out {
+		part.BuildMap()
+		out[v] = part
+	}
+
+	return out
+}
+
+// FlatMap returns a map which is the union of all the cfg's records' tuples' maps.
+// Only the first instance of a name is inserted.
+func (c Cfg) FlatMap() map[string]string {
+	out := make(map[string]string)
+	for _, r := range c.Records {
+		for _, t := range r.Tuples {
+			for n, v := range t.BuildMap() {
+				if _, ok := out[n]; ok {
+					// This entry exists
+					continue
+				}
+
+				if len(v) > 0 {
+					// Take first value
+					out[n] = v[0]
+				} else {
+					// No list, so this is empty string
+					out[n] = ""
+				}
+			}
+		}
+	}
+	return out
+}
+
+// BuildMap returns a map mapping record primary keys to tuple primary keys to attribute maps.
+func (c *Cfg) BuildMap() map[string]map[string]map[string][]string {
+	out := make(map[string]map[string]map[string][]string)
+
+	for _, r := range c.Records {
+		out[r.PrimaryKey()] = r.BuildMap()
+	}
+
+	c.Map = out
+	c.dirty = false
+	c.index = nil
+	return out
+}
+
+// Invalidate marks the cfg's maps as stale so that they are rebuilt by the next call to Maps, and discards the Lookup index.
+// Call Invalidate after modifying records in place rather than rebuilding after every edit.
+func (c *Cfg) Invalidate() {
+	c.dirty = true
+	c.index = nil
+}
+
+// Maps returns the cfg's map, rebuilding it only if it has been invalidated or never built.
+func (c *Cfg) Maps() map[string]map[string]map[string][]string {
+	c.ensureMap()
+	return c.Map
+}
+
+// Query returns the values found at 'path' in the cfg's map, which is either record/tuple/attribute or record/attribute.
+// A two part path collects the attribute's values across all of the record's tuples in order.
+// As with Map, the last record with a primary key is used and valueless attributes have no values.
+// The bool is false if any part of the path is not found or the path is malformed.
+func (c *Cfg) Query(path string) ([]string, bool) {
+	parts := strings.Split(path, "/")
+	m := c.Maps()
+
+	switch len(parts) {
+	case 2:
+		if _, ok := m[parts[0]]; !ok {
+			return nil, false
+		}
+
+		r, _ := c.LookupLast(parts[0])
+		vals, ok := attrValues(r.Tuples)[parts[1]]
+		return vals, ok
+
+	case 3:
+		vals, ok := m[parts[0]][parts[1]][parts[2]]
+		return vals, ok
+	}
+
+	return nil, false
+}
+
+// Rebuild the map if it is stale
+func (c *Cfg) ensureMap() {
+	if c.dirty || c.Map == nil {
+		c.BuildMap()
+	}
+}
+
+// Mark the maps and index stale after a mutator changes the records, Maps rebuilds them on demand
+func (c *Cfg) changed() {
+	c.Invalidate()
+}
+
+// Options controls optional parsing behavior for LoadWith.
+// Start from DefaultOptions to parse as Load does.
+type Options struct {
+	// DoubleQuoteEscaping makes a doubled quote within quotes a literal quote rather than closing and reopening
+	DoubleQuoteEscaping bool
+
+	// Expand resolves ${name} references in values, nil disables interpolation
+	Expand func(name string) (string, bool)
+	// ExpandStrict makes references which Expand can't resolve an error rather than literal
+	ExpandStrict bool
+	// ResolveRefs resolves ${name} references in values to the first value of an earlier attribute in the same record.
+	// References to later attributes are an error, as are cycles, references to names not in the record are left as-is.
+	ResolveRefs bool
+	// CollapseWhitespace folds runs of whitespace within values into a single space
+	CollapseWhitespace bool
+	// SplitNames, if set, splits names such as a.b=v on their first separator into a tuple keyed 'a' holding b=v.
+	// Such tuples are rejoined on emission.
+	SplitNames string
+	// AllowBackticks takes a value in backticks, as in k=`v`, literally until the closing backtick
+	AllowBackticks bool
+	// GreedyQuotes closes a quoted name or value at the last quote of its kind before the following whitespace, rather than the first.
+	// Quotes before it are literal, so k="a"b"c" is k with value a"b"c.
+	// This is ambiguous with whitespace in quotes: k="a" "b" is two attributes, as whitespace follows the first closing quote.
+	// A doubled quote is still an escape if DoubleQuoteEscaping is set.
+	GreedyQuotes bool
+	// DoubleEqualsEscape makes a doubled equals outside quotes a literal equals, so k=a==b is k with value a=b.
+	// Pairs are taken from the left, so k===v is a name k= with value v.
+	DoubleEqualsEscape bool
+	// Base64Names lists names whose values are decoded from base64, as emitted with Base64Names set.
+	// Padding is optional, as '=' must be quoted in a value.
+	Base64Names []string
+	// KeepRaw records the source text of each attribute in its Raw field to emit unedited attributes exactly as loaded.
+	// The whitespace following each attribute and indenting each tuple is kept too.
+	KeepRaw bool
+	// EscapeControl decodes \xNN escapes in values, as emitted with EscapeControl set
+	EscapeControl bool
+	// MaxRecords, if positive, makes input with more records than it an error, parsing stops at the first record over
+	MaxRecords int
+	// IsRecordStart, if set, decides which lines start a new record in place of indentation.
+	// It is passed each line with attributes, without its line ending, and other lines continue the current record.
+	IsRecordStart func(line string) bool
+	// InferSeparator treats the token following an unquoted valueless name as its value, so 'key value' is key=value.
+	// Tokens pair from left to right, 'a b c' is a=b and c, and a name written with '=' never takes the following token.
+	InferSeparator bool
+}
+
+const errNoParent = "no parent record for indented tuple, the first tuple must be unindented and thus start a record"
+
+// ParseError is a problem at a position in a cfg file, as returned by Load and Decoder.Next.
+type ParseError struct {
+	Line uint64 // Line number, starting at 1
+	Col  uint64 // Rune within the line where the problem starts, starting at 1
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s near line:rune of %d:%d", e.Msg, e.Line, e.Col)
+}
+
+// DefaultOptions returns the Options used by Load, with DoubleQuoteEscaping set.
+// AllowBackticks, Base64Names, and EscapeControl are seeded from the globals of the same name, so that files emitted with them set load back.
+func DefaultOptions() Options {
+	return Options{
+		DoubleQuoteEscaping: true,
+		AllowBackticks:      AllowBackticks,
+		Base64Names:         append([]string(nil), Base64Names...),
+		EscapeControl:       EscapeControl,
+	}
+}
+
+// Load parses a cfg file and returns a complete cfg.
+func Load(r io.Reader) (Cfg, error) {
+	return LoadWith(r, DefaultOptions())
+}
+
+// LoadContext parses a cfg file as Load does, returning the context's error if it is done before parsing finishes.
+// Parsing stops at the next record once the context is done.
+// A read from 'r' which is blocked at that time is abandoned, it finishes in the background once the read returns.
+func LoadContext(ctx context.Context, r io.Reader) (Cfg, error) {
+	type result struct {
+		c   Cfg
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		c, _, err := load(ctx, r, DefaultOptions(), false)
+		done <- result{c, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.c, res.err
+	case <-ctx.Done():
+		return Cfg{}, ctx.Err()
+	}
+}
+
+// LoadTimeout parses a cfg file as Load does, returning context.DeadlineExceeded if parsing takes longer than 'd'.
+func LoadTimeout(r io.Reader, d time.Duration) (Cfg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	return LoadContext(ctx, r)
+}
+
+// LoadMaybeGzip parses a cfg file which may be gzip-compressed, decompressing it if it begins with the gzip magic bytes.
+func LoadMaybeGzip(r io.Reader) (Cfg, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		// Too short or not gzip, parse as-is
+		return Load(br)
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return Cfg{}, err
+	}
+	defer zr.Close()
+
+	return Load(zr)
+}
+
+// Dedent returns a reader of 'r' with the leading whitespace common to every non-blank line removed.
+// Indentation beyond the common prefix, marking child tuples, is kept.
+// All of 'r' is read up front, a read error is returned by the first Read of the returned reader.
+func Dedent(r io.Reader) io.Reader {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return &errReader{err}
+	}
+
+	lines := strings.SplitAfter(string(b), "\n")
+	prefix := ""
+	found := false
+
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		lead := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found {
+			prefix = lead
+			found = true
+			continue
+		}
+
+		// Shorten the prefix until it is shared by this line
+		i := 0
+		for i < len(prefix) && i < len(lead) && prefix[i] == lead[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+
+	var out strings.Builder
+	for _, line := range lines {
+		out.WriteString(strings.TrimPrefix(line, prefix))
+	}
+
+	return strings.NewReader(out.String())
+}
+
+// Reader which always fails with err
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// LoadWith parses a cfg file using the options in 'o' and returns a complete cfg.
+func LoadWith(r io.Reader, o Options) (Cfg, error) {
+	c, _, err := load(context.Background(), r, o, false)
+	return c, err
+}
+
+// LoadVerbose parses a cfg file as LoadWith does, but recovers from problems it can skip past.
+// Each indented tuple without a parent record is skipped and reported in the returned warnings.
+func LoadVerbose(r io.Reader, o Options) (Cfg, []string, error) {
+	c, warnings, err := load(context.Background(), r, o, true)
+
+	var out []string
+	for _, w := range warnings {
+		out = append(out, w.Error())
+	}
+
+	return c, out, err
+}
+
+// Parse a cfg file until 'ctx' is done, skipping orphaned tuples as warnings if 'skip' is set
+func load(ctx context.Context, r io.Reader, o Options, skip bool) (Cfg, []*ParseError, error) {
+	c := Cfg{}
+	d := NewDecoder(r)
+	d.Options = o
+	d.skip = skip
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return c, d.warnings, err
+		}
+
+		rec, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if d.rec != nil {
+				// Keep the record in progress, as parsed so far
+				c.Records = append(c.Records, d.rec)
+			}
+			return c, d.warnings, err
+		}
+
+		c.Records = append(c.Records, rec)
+	}
+
+	c.BuildMap()
+
+	if Validator != nil {
+		if err := Validator(c); err != nil {
+			return c, d.warnings, err
+		}
+	}
+
+	return c, d.warnings, nil
+}
+
+// Parse a line into a tuple, reporting whether it is indented and the rune it starts at for errors.
+// A nil tuple is returned for lines without attributes.
+func parseLine(line string, ln uint64, word *bytes.Buffer, o Options) (*Tuple, bool, uint64, error) {
+	src := strings.TrimRight(line, "\r\n")
+
+	// Trim comments
+	comment := ""
+	if ci := commentIndex(line, o); ci >= 0 {
+		comment = strings.TrimSpace(line[ci+1:])
+		line = line[:ci] + "\n"
+	}
+
+	// Whitespace beginning index and first 'letter' index
+	wi := strings.IndexFunc(line, unicode.IsSpace)
+	li := strings.IndexFunc(line, func(r rune) bool {
+		return !unicode.IsSpace(r)
+	})
+
+	in := false
+
+	if wi < li {
+		// Leading whitespace, Tuple is a part of a record
+		chat("tuple in record →", line)
+		in = true
+
+	} else if (wi < 0 || wi > li) && li >= 0 {
+		// No leading whitespace, start a new record
+		chat("new record →", line)
+		in = false
+
+	} else {
+		// Empty line
+		chat("empty →", line)
+		return nil, false, 0, nil
+	}
+
+	tuple, err := scanTuple(line, ln, word, o)
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	col := uint64(utf8.RuneCountInString(line[:li])) + 1
+	tuple.Depth = li
+	if o.KeepRaw {
+		tuple.indent = line[:li]
+	}
+
+	if o.IsRecordStart != nil {
+		in = !o.IsRecordStart(src)
+	}
+
+	// Tuple is finished
+	if len(tuple.Attributes) < 1 {
+		// Every attribute was discarded, this tuple can't be keyed
+		if Strict {
+			return nil, false, 0, &ParseError{Line: ln, Col: col, Msg: "no usable attributes in tuple"}
+		}
+
+		chat("discarding empty tuple →", line)
+		return nil, false, 0, nil
+	}
+
+	// A trailing comment belongs to the last attribute on the line
+	tuple.Attributes[len(tuple.Attributes)-1].Comment = comment
+
+	if Strict {
+		// A name can't be both a flag and valued
+		valued := make(map[string]bool)
+		for _, a := range tuple.Attributes {
+			v := a.Value != "" || a.QuotedEmpty
+			if prev, ok := valued[a.Name]; ok && prev != v {
+				return nil, false, 0, &ParseError{Line: ln, Col: at(a, col), Msg: "name " + Quote(a.Name) + " is both valueless and valued in tuple"}
+			}
+			valued[a.Name] = v
+		}
+	}
+
+	if o.CollapseWhitespace {
+		for _, a := range tuple.Attributes {
+			a.Value = collapse(a.Value)
+		}
+	}
+
+	if o.Expand != nil {
+		for _, a := range tuple.Attributes {
+			a.Value, err = expand(a.Value, o.Expand, o.ExpandStrict)
+			if err != nil {
+				return nil, false, 0, &ParseError{Line: ln, Col: at(a, col), Msg: err.Error()}
+			}
+		}
+	}
+
+	if o.EscapeControl {
+		for _, a := range tuple.Attributes {
+			a.Value = unescapeControl(a.Value)
+		}
+	}
+
+	for _, a := range tuple.Attributes {
+		if !contains(o.Base64Names, a.Name) {
+			continue
+		}
+
+		b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(a.Value, "="))
+		if err != nil {
+			return nil, false, 0, &ParseError{Line: ln, Col: at(a, col), Msg: "invalid base64 value for " + Quote(a.Name) + ": " + err.Error()}
+		}
+		a.Value = string(b)
+	}
+
+	return tuple, in, col, nil
+}
+
+// The rune an attribute starts at, or 'col' if it was not located
+func at(a *Attribute, col uint64) uint64 {
+	if a.col > 0 {
+		return a.col
+	}
+
+	return col
+}
+
+// Set the source position of each attribute of 't' from its byte span in 'line', the comment-free line it was scanned from,
+// and Raw with the whitespace following it if keeping it.
+// Only the line is set for attributes without a span.
+func locate(t *Tuple, line string, ln uint64, spans [][2]int, o Options) {
+	trimmed := len(strings.TrimRight(line, "\r\n"))
+
+	for i, a := range t.Attributes {
+		a.line = ln
+		start, end := spans[i][0], spans[i][1]
+		if start < 0 {
+			continue
+		}
+
+		a.col = uint64(utf8.RuneCountInString(line[:start])) + 1
+		if !o.KeepRaw {
+			continue
+		}
+
+		a.Raw = line[start:end]
+		a.raw = rawAttr{a.Name, a.Value, a.QuotedEmpty}
+
+		next := trimmed
+		if i+1 < len(spans) && spans[i+1][0] >= end {
+			next = spans[i+1][0]
+		}
+		if next < end {
+			next = end
+		}
+		rest := line[end:next]
+		a.sep = rest[:len(rest)-len(strings.TrimLeftFunc(rest, unicode.IsSpace))]
+	}
+}
+
+// Whether 'list' contains 's'
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Encode control characters and backslashes in 's' as \xNN
+func escapeControl(s string) string {
+	var out strings.Builder
+
+	for _, r := range s {
+		if r == '\\' || unicode.IsControl(r) {
+			fmt.Fprintf(&out, "\\x%02x", r)
+			continue
+		}
+		out.WriteRune(r)
+	}
+
+	return out.String()
+}
+
+// Decode \xNN escapes in 's', other backslashes are left as-is
+func unescapeControl(s string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				out.WriteRune(rune(n))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+
+	return out.String()
+}
+
+// Split attributes with names containing 'sep' into tuples keyed by the name's first part.
+// The first tuple returned takes the place of 't', the rest follow it.
+func splitNames(t *Tuple, sep string) Tuples {
+	if sep == "" {
+		return Tuples{t}
+	}
+
+	var keep Attributes
+	var split Tuples
+	byKey := make(map[string]*Tuple)
+
+	for _, a := range t.Attributes {
+		key, rest, ok := strings.Cut(a.Name, sep)
+		if !ok || key == "" || rest == "" {
+			keep = append(keep, a)
+			continue
+		}
+
+		st, ok := byKey[key]
+		if !ok {
+			st = &Tuple{Attributes: Attributes{{Name: key}}, Depth: t.Depth, Split: sep}
+			byKey[key] = st
+			split = append(split, st)
+		}
+
+		a.Name = rest
+		st.Attributes = append(st.Attributes, a)
+	}
+
+	if len(keep) < 1 {
+		return split
+	}
+
+	t.Attributes = keep
+	return append(Tuples{t}, split...)
+}
+
+// Index of the '#' beginning a comment in 'line', ignoring any within quotes, or -1.
+func commentIndex(line string, o Options) int {
+	var quote rune
+	var prev rune
+
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				// Closed, a doubled quote reopens
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '`' && o.AllowBackticks && prev == '=':
+			quote = r
+		case r == '#':
+			return i
+		}
+		prev = r
+	}
+
+	return -1
+}
+
+// Fold runs of whitespace in 's' into a single space.
+func collapse(s string) string {
+	var out strings.Builder
+	space := false
+
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+
+		if space {
+			out.WriteRune(' ')
+			space = false
+		}
+		out.WriteRune(r)
+	}
+
+	if space {
+		out.WriteRune(' ')
+	}
+
+	return out.String()
+}
+
+// ParseRecord parses exactly one record, which may have indented tuples, from 's'.
+func ParseRecord(s string) (*Record, error) {
+	c, err := Load(strings.NewReader(s))
+	if err != nil {
+		return nil, err
+	}
+
+	if n := len(c.Records); n != 1 {
+		return nil, fmt.Errorf("expected one record, found %d", n)
+	}
+
+	return c.Records[0], nil
+}
+
+// Interpolate ${name} references in 's' using 'resolve'.
+// Unresolved references are left as-is unless 'strict' is set.
+func expand(s string, resolve func(string) (string, bool), strict bool) (string, error) {
+	var out strings.Builder
+
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			break
+		}
+
+		end := strings.IndexRune(s[start:], '}')
+		if end < 0 {
+			// No closing brace, nothing more to expand
+			break
+		}
+		end += start
+
+		out.WriteString(s[:start])
+		name := s[start+2 : end]
+		v, ok := resolve(name)
+		switch {
+		case ok:
+			out.WriteString(v)
+		case strict:
+			return "", errors.New("unresolved variable ${" + name + "}")
+		default:
+			out.WriteString(s[start : end+1])
+		}
+
+		s = s[end+1:]
+	}
+
+	out.WriteString(s)
+	return out.String(), nil
+}
+
+// Resolve ${name} references in the values of 'r' to the first value of earlier attributes in 'r'
+func resolveRefs(r *Record) error {
+	first := make(map[string]string) // First value of every name in the record
+	for _, t := range r.Tuples {
+		for _, a := range t.Attributes {
+			if _, ok := first[a.Name]; !ok {
+				first[a.Name] = a.Value
+			}
+		}
+	}
+
+	defined := make(map[string]string) // First value of every name resolved so far
+	for _, t := range r.Tuples {
+		for _, a := range t.Attributes {
+			var bad error
+			v, _ := expand(a.Value, func(n string) (string, bool) {
+				if v, ok := defined[n]; ok {
+					return v, true
+				}
+
+				if _, ok := first[n]; ok && bad == nil {
+					kind := "forward"
+					if refers(first, n, a.Name, make(map[string]bool)) {
+						kind = "cyclic"
+					}
+					bad = fmt.Errorf("%s reference ${%s} in %s of record %s", kind, n, Quote(a.Name), Quote(r.PrimaryKey()))
+				}
+
+				return "", false
+			}, false)
+			if bad != nil {
+				return bad
+			}
+
+			a.Value = v
+			if _, ok := defined[a.Name]; !ok {
+				defined[a.Name] = v
+			}
+		}
+	}
+
+	return nil
+}
+
+// Whether the value of 'from' in 'values' references 'to', directly or through other names
+func refers(values map[string]string, from, to string, seen map[string]bool) bool {
+	if seen[from] {
+		return false
+	}
+	seen[from] = true
+
+	found := false
+	expand(values[from], func(n string) (string, bool) {
+		if n == to || refers(values, n, to, seen) {
+			found = true
+		}
+		return "", false
+	}, false)
+
+	return found
+}
+
+// ParseAttribute parses a single attribute such as name=value from 's'.
+// It is an error for 's' to contain zero or more than one attribute.
+func ParseAttribute(s string) (*Attribute, error) {
+	tuple, err := scanTuple(s+"\n", 1, new(bytes.Buffer), DefaultOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	switch n := len(tuple.Attributes); {
+	case n < 1:
+		return nil, errors.New("no attribute in " + s)
+	case n > 1:
+		return nil, fmt.Errorf("expected one attribute, found %d in %s", n, s)
+	}
+
+	return tuple.Attributes[0], nil
+}
+
+// scanTuple parses a single line into a tuple, 'ln' is used for error positions.
+// The line must end in whitespace for its final attribute to be committed.
+// 'word' is scratch space which may be reused between calls.
+func scanTuple(line string, ln uint64, word *bytes.Buffer, o Options) (*Tuple, error) {
+	var rn uint64
+	var open uint64 // Rune which opened the current quote
+
+	lr := strings.NewReader(line)
+
+	tuple := &Tuple{Attributes: []*Attribute{}, Map: make(map[string][]string)}
+	var spans [][2]int  // Byte offsets of each attribute in 'line'
+	start, cut := -1, 0 // Start of the attribute in progress and where the next commit ends it
+	tok, gap := 0, 0    // Start of the current token and end of the one before it
+	eq := false         // An '=' preceded the word, even if the name is empty
+	commit := func(n, v string) {
+		assigned := eq
+		eq = false
+		span := [2]int{start, cut}
+		start = -1
+
+		// Discard empty attributes (usually a bug)
+		if n == "" && v == "" {
+			return
+		}
+
+		// Insert attribute
+		tuple.Attributes = append(tuple.Attributes, &Attribute{Name: n, Value: v, Assigned: assigned})
+		spans = append(spans, span)
+	}
+	lone := func(n, v string) {
+		// The name ended with the previous token, the current token starts the next attribute
+		c := cut
+		cut = gap
+		commit(n, v)
+		cut = c
+		start = tok
+	}
+	quoted := func(n, v string) {
+		// The closing quote is part of the attribute
+		cut = len(line) - lr.Len()
+		before := len(tuple.Attributes)
+		commit(n, v)
+		if v == "" && len(tuple.Attributes) > before {
+			// k="" is an explicitly empty value
+			tuple.Attributes[len(tuple.Attributes)-1].QuotedEmpty = true
+		}
+	}
+
+	// Parse line
+	state := name
+
+	n := ""
+	v := ""
+	word.Reset()
+	between := true // The previous rune separated tokens
+scan:
+	for rn = 1; lr.Len() > 0; rn++ {
+		if state != squotebegin && state != dquotebegin {
+			// This rune may open a quote
+			open = rn
+		}
+
+		pos := len(line) - lr.Len()
+		cut = pos
+		r, _, err := lr.ReadRune()
+		if Chatty {
 			chat(fmt.Sprintf("%c ⇒ %v\n", r, state))
+		}
+
+		separates := unicode.IsSpace(r) && state != squotebegin && state != dquotebegin
+		switch {
+		case separates && !between:
+			gap = pos
+		case !separates && between:
+			tok = pos
+		}
+		between = separates
+		if start < 0 && !separates {
+			start = pos
+		}
+		if err == io.EOF {
+			switch state {
+			case value:
+				// Finish the value
+				v = word.String()
+				word.Reset()
+				commit(n, v)
+				n = ""
+				v = ""
+
+			default:
+				break scan
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case unicode.IsSpace(r):
+			switch state {
+			case squotebegin:
+				fallthrough
+			case dquotebegin:
+				word.WriteRune(r)
+
+			case squoteend:
+				fallthrough
+			case dquoteend:
+				fallthrough
+			case rawend:
+				fallthrough
+			case value:
+				// Finish a value
+				v = word.String()
+				word.Reset()
+				commit(n, v)
+				n = ""
+				v = ""
+				state = name
+
+			case equals:
+				// A name without a value was had, now this is a new name
+				word.Reset()
+				commit(n, v)
+				n = ""
+				v = ""
+				state = name
+
+			case name:
+				if o.InferSeparator {
+					switch {
+					case word.Len() < 1:
+						// Repeated whitespace
+					case n == "":
+						// This name may take the next token as its value
+						n = word.String()
+						word.Reset()
+					default:
+						// The token following a name is its value
+						v = word.String()
+						word.Reset()
+						commit(n, v)
+						n = ""
+						v = ""
+					}
+					continue scan
+				}
+
+				// A space after a name, for optional '=' after valueless name
+				// Finish a name
+				n = word.String()
+				word.Reset()
+				commit(n, v)
+				n = ""
+				v = ""
+				state = name
+
+			default:
+			}
+			continue scan
+
+		case r == '=':
+			if o.DoubleEqualsEscape && (state == name || state == value || state == equals) {
+				next, _, err := lr.ReadRune()
+				if err == nil && next == '=' {
+					// We are inserting a literal equals
+					// k=a==b ⇒ a=b
+					rn++
+					if state == equals {
+						state = value
+					}
+					word.WriteRune('=')
+					continue scan
+				}
+				if err == nil {
+					lr.UnreadRune()
+				}
+			}
+
+			switch state {
+			// When in quotes, append
+			case squotebegin:
+				fallthrough
+			case dquotebegin:
+				word.WriteRune('=')
+
+			case name:
+				if o.InferSeparator && n != "" {
+					// The preceding name has no value
+					lone(n, v)
+				}
+
+				// Finish the name, no spaces here
+				n = word.String()
+				word.Reset()
+
+				state = equals
+				eq = true
+
+			default:
+				state = equals
+				eq = true
+				continue scan
+			}
+
+		case r == '`' && o.AllowBackticks && state == equals:
+			// A raw value, taken literally until the closing backtick
+			for {
+				next, _, err := lr.ReadRune()
+				if err == io.EOF {
+					return nil, &ParseError{Line: ln, Col: open, Msg: "unterminated backtick (`)"}
+				}
+				if err != nil {
+					return nil, err
+				}
+				rn++
+
+				if next == '`' {
+					break
+				}
+				word.WriteRune(next)
+			}
+
+			v = word.String()
+			word.Reset()
+			quoted(n, v)
+			n = ""
+			v = ""
+			state = rawend
+
+		case r == '\'':
+			next, _, err := lr.ReadRune()
+			if err == io.EOF {
+				return nil, &ParseError{Line: ln, Col: rn, Msg: "unclosed single quote (') at EOF"}
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			literal := false
+			if next == '\'' && state == squotebegin && o.DoubleQuoteEscaping {
+				literal = true
+				rn++
+			} else {
+				lr.UnreadRune()
+			}
+			if !literal && state == squotebegin && o.GreedyQuotes && laterQuote(line[len(line)-lr.Len():], '\'') {
+				// Only the token's final quote closes
+				literal = true
+			}
+
+			if literal || state == dquotebegin {
+				// We are inserting a literal single quote
+				// 'foo '' bar' ⇒ foo ' bar
+				word.WriteRune('\'')
+				continue scan
+			}
+
+			switch state {
+			case squotebegin:
+				// Commit the word
+				if n == "" && !eq {
+					// We are the name
+					n = word.String()
+					word.Reset()
+
+				} else {
+					// We are the value, the name may be empty as in ="v"
+					v = word.String()
+					word.Reset()
+					quoted(n, v)
+					n = ""
+					v = ""
+				}
+				state = squoteend
+
+			case name:
+				// Guard if word is empty
+				if word.Len() < 1 {
+					state = squotebegin
+					continue scan
+				}
+
+				if o.InferSeparator && n != "" {
+					// The preceding name has no value
+					lone(n, v)
+				}
+
+				// A name preceded us, commit it, we start the next attribute
+				n = word.String()
+				word.Reset()
+				commit(n, v)
+				start = cut
+				n = ""
+				v = ""
+				state = squotebegin
+
+			default:
+				state = squotebegin
+			}
+
+		case r == '"':
+			next, _, err := lr.ReadRune()
 			if err == io.EOF {
-				switch state {
-				case value:
-					// Finish the value
+				return nil, &ParseError{Line: ln, Col: rn, Msg: "unclosed double quote (\") at EOF"}
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			literal := false
+			if next == '"' && state == dquotebegin && o.DoubleQuoteEscaping {
+				literal = true
+				rn++
+			} else {
+				lr.UnreadRune()
+			}
+			if !literal && state == dquotebegin && o.GreedyQuotes && laterQuote(line[len(line)-lr.Len():], '"') {
+				// Only the token's final quote closes
+				literal = true
+			}
+
+			if literal || state == squotebegin {
+				// We are inserting a literal double quote
+				// "foo "" bar" ⇒ foo " bar
+				word.WriteRune('"')
+				continue scan
+			}
+
+			switch state {
+			case dquotebegin:
+				// Commit the word
+				if n == "" && !eq {
+					// We are the name
+					n = word.String()
+					word.Reset()
+
+				} else {
+					// We are the value, the name may be empty as in ="v"
 					v = word.String()
 					word.Reset()
-					commit <- &Attribute{n, v}
+					quoted(n, v)
 					n = ""
 					v = ""
+				}
+				state = dquoteend
+
+			case name:
+				// Guard if word is empty
+				if word.Len() < 1 {
+					state = dquotebegin
+					continue scan
+				}
+
+				if o.InferSeparator && n != "" {
+					// The preceding name has no value
+					lone(n, v)
+				}
+
+				// A name preceded us, commit it, we start the next attribute
+				n = word.String()
+				word.Reset()
+				commit(n, v)
+				start = cut
+				n = ""
+				v = ""
+				state = dquotebegin
+
+			default:
+				state = dquotebegin
+			}
+
+		default:
+			// Part of a name or value
+			switch state {
+			case equals:
+				state = value
+			}
+			word.WriteRune(r)
+		}
+	}
+	if o.InferSeparator && state == name && n != "" {
+		// The final name has no value
+		cut = gap
+		commit(n, v)
+	}
+
+	switch state {
+	case squotebegin:
+		return nil, &ParseError{Line: ln, Col: open, Msg: `unterminated single quote (')`}
+	case dquotebegin:
+		return nil, &ParseError{Line: ln, Col: open, Msg: `unterminated double quote (")`}
+	}
+
+	locate(tuple, line, ln, spans, o)
+	return tuple, nil
+}
+
+// Whether 'q' occurs in 'rest' before its first whitespace
+func laterQuote(rest string, q rune) bool {
+	if i := strings.IndexFunc(rest, unicode.IsSpace); i >= 0 {
+		rest = rest[:i]
+	}
+
+	return strings.ContainsRune(rest, q)
+}
+
+// Emit takes writes the Cfg's string representation to 'w'.
+func (c Cfg) Emit(w io.Writer) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	out := c.String()
+	switch FinalNewline {
+	case ForceNewline:
+		if !strings.HasSuffix(out, LineEnding) {
+			out += LineEnding
+		}
+	case StripNewline:
+		out = strings.TrimSuffix(out, LineEnding)
+	}
+
+	bw.WriteString(out)
+}
 
-				default:
-					break scan
-				}
-			}
-			if err != nil {
-				return c, err
-			}
-
-			switch {
-			case unicode.IsSpace(r):
-				switch state {
-				case squotebegin:
-					fallthrough
-				case dquotebegin:
-					word.WriteRune(r)
-
-				case squoteend:
-					fallthrough
-				case dquoteend:
-					fallthrough
-				case value:
-					// Finish a value
-					v = word.String()
-					word.Reset()
-					commit <- &Attribute{n, v}
-					n = ""
-					v = ""
-					state = name
+// EmitOrdered writes the cfg to 'w' with records in the primary key order of 'keyOrder'.
+// Records whose key is not listed follow in their original order, listed keys without records are skipped.
+func (c Cfg) EmitOrdered(w io.Writer, keyOrder []string) error {
+	bw := bufio.NewWriter(w)
 
-				case equals:
-					// A name without a value was had, now this is a new name
-					word.Reset()
-					commit <- &Attribute{n, v}
-					n = ""
-					v = ""
-					state = name
+	for _, r := range c.ordered(keyOrder) {
+		if _, err := bw.WriteString(r.String()); err != nil {
+			return err
+		}
+	}
 
-				case name:
-					// A space after a name, for optional '=' after valueless name
-					// Finish a name
-					n = word.String()
-					word.Reset()
-					commit <- &Attribute{n, v}
-					n = ""
-					v = ""
-					state = name
+	return bw.Flush()
+}
 
-				default:
-				}
-				continue scan
+// EmitIndex writes a line of each record's primary key and primary value, separated by a tab, to 'w'.
+// The index is a sidecar for fast lookups and is not a cfg file, keys and values are written unquoted.
+func (c Cfg) EmitIndex(w io.Writer) error {
+	bw := bufio.NewWriter(w)
 
-			case r == '=':
-				switch state {
-				// When in quotes, append
-				case squotebegin:
-					fallthrough
-				case dquotebegin:
-					word.WriteRune('=')
+	for _, r := range c.Records {
+		if _, err := bw.WriteString(r.PrimaryKey() + "\t" + r.PrimaryValue() + "\n"); err != nil {
+			return err
+		}
+	}
 
-				case name:
-					// Finish the name, no spaces here
-					n = word.String()
-					word.Reset()
+	return bw.Flush()
+}
 
-					state = equals
+// EmitDelta writes only the records which are new or changed relative to 'baseline' to 'w'.
+// The nth record with a given primary key is compared against the nth such record in 'baseline'.
+func (c Cfg) EmitDelta(w io.Writer, baseline Cfg) error {
+	bw := bufio.NewWriter(w)
 
-				default:
-					state = equals
-					continue scan
-				}
+	seen := make(map[string]int)
+	for _, r := range c.Records {
+		k := r.PrimaryKey()
+		i := seen[k]
+		seen[k]++
 
-			case r == '\'':
-				next, _, err := lr.ReadRune()
-				if err == io.EOF {
-					return c, errors.New("unclosed single quote (') at EOF")
-				}
-				if err != nil {
-					return c, err
-				}
+		if old, ok := baseline.Lookup(k); ok && i < len(old) && r.Equal(old[i]) {
+			continue
+		}
 
-				literal := false
-				if next == '\'' {
-					literal = true
-					rn++
-				} else {
-					lr.UnreadRune()
-				}
+		if _, err := bw.WriteString(r.String()); err != nil {
+			return err
+		}
+	}
 
-				if literal || state == dquotebegin {
-					// We are inserting a literal single quote
-					// 'foo '' bar' ⇒ foo ' bar
-					word.WriteRune('\'')
-					continue scan
-				}
+	return bw.Flush()
+}
 
-				switch state {
-				case squotebegin:
-					// Commit the word
-					if n == "" {
-						// We are the name
-						n = word.String()
-						word.Reset()
+// RoundTrips reports whether the Cfg's emission loads back to an equal Cfg.
+func (c Cfg) RoundTrips() bool {
+	var sb strings.Builder
+	c.Emit(&sb)
 
-					} else {
-						// We are the value
-						v = word.String()
-						word.Reset()
-						commit <- &Attribute{n, v}
-						n = ""
-						v = ""
-					}
-					state = squoteend
+	after, err := Load(strings.NewReader(sb.String()))
+	if err != nil {
+		return false
+	}
 
-				case name:
-					// Guard if word is empty
-					if word.Len() < 1 {
-						state = squotebegin
-						continue scan
-					}
+	return c.Equal(after)
+}
 
-					// A name preceded us, commit it
-					n = word.String()
-					word.Reset()
-					commit <- &Attribute{n, v}
-					n = ""
-					v = ""
-					state = squotebegin
+/* Copying routines */
 
-				default:
-					state = squotebegin
-				}
+// Template returns a copy of the cfg with every value blanked, keeping the first record of each primary key.
+// Emitting the template gives a fill-in-the-blanks cfg of the same structure.
+func (c Cfg) Template() Cfg {
+	out := Cfg{}
+	seen := make(map[string]bool)
 
-			case r == '"':
-				next, _, err := lr.ReadRune()
-				if err == io.EOF {
-					return c, errors.New("unclosed double quote (\") at EOF")
-				}
-				if err != nil {
-					return c, err
-				}
+	for _, r := range c.Records {
+		k := r.PrimaryKey()
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
 
-				literal := false
-				if next == '"' {
-					literal = true
-					rn++
-				} else {
-					lr.UnreadRune()
-				}
+		r = r.Clone()
+		for _, t := range r.Tuples {
+			for _, a := range t.Attributes {
+				a.Value = ""
+				a.QuotedEmpty = false
+			}
+			t.Map = t.BuildMap()
+		}
+		r.Map = r.BuildMap()
 
-				if literal || state == squotebegin {
-					// We are inserting a literal double quote
-					// "foo "" bar" ⇒ foo " bar
-					word.WriteRune('"')
-					continue scan
-				}
+		out.Records = append(out.Records, r)
+	}
 
-				switch state {
-				case dquotebegin:
-					// Commit the word
-					if n == "" {
-						// We are the name
-						n = word.String()
-						word.Reset()
+	out.BuildMap()
+	return out
+}
 
-					} else {
-						// We are the value
-						v = word.String()
-						word.Reset()
-						commit <- &Attribute{n, v}
-						n = ""
-						v = ""
-					}
-					state = dquoteend
+// Clone returns a deep copy of the cfg with its map built.
+func (c Cfg) Clone() Cfg {
+	out := Cfg{}
+	for _, r := range c.Records {
+		out.Records = append(out.Records, r.Clone())
+	}
 
-				case name:
-					// Guard if word is empty
-					if word.Len() < 1 {
-						state = dquotebegin
-						continue scan
-					}
+	out.BuildMap()
+	return out
+}
 
-					// A name preceded us, commit it
-					n = word.String()
-					word.Reset()
-					commit <- &Attribute{n, v}
-					n = ""
-					v = ""
-					state = dquotebegin
+// Clone returns a deep copy of the record.
+func (r *Record) Clone() *Record {
+	out := &Record{}
+	for _, t := range r.Tuples {
+		out.Tuples = append(out.Tuples, t.Clone())
+	}
 
-				default:
-					state = dquotebegin
-				}
+	out.Map = out.BuildMap()
+	return out
+}
 
-			default:
-				// Part of a name or value
-				switch state {
-				case equals:
-					state = value
-				}
-				word.WriteRune(r)
+// Clone returns a deep copy of the tuple.
+func (t *Tuple) Clone() *Tuple {
+	out := &Tuple{Depth: t.Depth, Split: t.Split}
+	for _, a := range t.Attributes {
+		ac := *a
+		if a.Meta != nil {
+			ac.Meta = make(map[string]string)
+			for k, v := range a.Meta {
+				ac.Meta[k] = v
 			}
 		}
-		close(commit)
-		tuple := <-done
+		out.Attributes = append(out.Attributes, &ac)
+	}
 
-		pos := fmt.Sprintf("near line:rune of %d:%d", ln, rn)
-		switch state {
-		case squotebegin:
-			return c, errors.New(`unterminated single quote (') ` + pos)
-		case dquotebegin:
-			return c, errors.New(`unterminated double quote (") ` + pos)
-		}
+	out.Map = out.BuildMap()
+	return out
+}
+
+/* Comparison routines */
+
+// Hash returns a hash of the cfg's records, tuples, and attributes in order.
+// Cfgs which are Equal hash equally, regardless of their source formatting.
+func (c Cfg) Hash() uint64 {
+	h := fnv.New64a()
+	var n [8]byte
+
+	// Prefix groups with their counts and fields with their lengths, so content can't run together or pass as structure
+	count := func(l int) {
+		binary.LittleEndian.PutUint64(n[:], uint64(l))
+		h.Write(n[:])
+	}
+	write := func(s string) {
+		count(len(s))
+		h.Write([]byte(s))
+	}
 
-		// Tuple is finished
-		if in {
-			// Append Tuple to last record
-			last := len(c.Records) - 1
-			if last < 0 {
-				return c, errors.New("no parent record for indented tuple, the first tuple must be unindented and thus start a record " + pos)
+	count(len(c.Records))
+	for _, r := range c.Records {
+		count(len(r.Tuples))
+		for _, t := range r.Tuples {
+			count(len(t.Attributes))
+			for _, a := range t.Attributes {
+				write(a.Name)
+				write(a.Value)
 			}
+		}
+	}
 
-			c.Records[last].Tuples = append(c.Records[last].Tuples, tuple)
+	return h.Sum64()
+}
 
-		} else {
-			// New Record with just this tuple
-			c.Records = append(c.Records, &Record{
-				Tuples: []*Tuple{
-					tuple,
-				},
-			})
+// Equal reports whether two cfgs contain the same records in the same order.
+func (c Cfg) Equal(o Cfg) bool {
+	if len(c.Records) != len(o.Records) {
+		return false
+	}
+
+	for i, r := range c.Records {
+		if !r.Equal(o.Records[i]) {
+			return false
 		}
 	}
 
-	c.BuildMap()
+	return true
+}
+
+// Equal reports whether two records contain the same tuples in the same order.
+func (r *Record) Equal(o *Record) bool {
+	if len(r.Tuples) != len(o.Tuples) {
+		return false
+	}
 
-	return c, nil
+	for i, t := range r.Tuples {
+		if !t.Equal(o.Tuples[i]) {
+			return false
+		}
+	}
+
+	return true
 }
 
-// Emit takes writes the Cfg's string representation to 'w'.
-func (c Cfg) Emit(w io.Writer) {
-	bw := bufio.NewWriter(w)
-	defer bw.Flush()
+// SameKeys reports whether two cfgs have the same set of record primary keys, regardless of order.
+func (c Cfg) SameKeys(o Cfg) bool {
+	keys := make(map[string]bool)
+	for _, k := range c.Keys() {
+		keys[k] = false
+	}
+
+	for _, k := range o.Keys() {
+		if _, ok := keys[k]; !ok {
+			return false
+		}
+		keys[k] = true
+	}
+
+	for _, seen := range keys {
+		if !seen {
+			return false
+		}
+	}
+
+	return true
+}
+
+// EqualUnordered reports whether two records contain the same values for each name, regardless of order.
+func (r *Record) EqualUnordered(o *Record) bool {
+	rv, ov := r.values(), o.values()
+	if len(rv) != len(ov) {
+		return false
+	}
+
+	for n, vs := range rv {
+		ovs, ok := ov[n]
+		if !ok || len(vs) != len(ovs) {
+			return false
+		}
+
+		for i := range vs {
+			if vs[i] != ovs[i] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Sorted values of every name across all of the record's tuples
+func (r *Record) values() map[string][]string {
+	out := attrValues(r.Tuples)
+	for _, vs := range out {
+		sort.Strings(vs)
+	}
 
-	bw.WriteString(c.String())
+	return out
+}
+
+// Equal reports whether two tuples contain the same attributes in the same order.
+// Tuples split from names must also share their separator.
+func (t *Tuple) Equal(o *Tuple) bool {
+	if len(t.Attributes) != len(o.Attributes) || t.Split != o.Split {
+		return false
+	}
+
+	for i, a := range t.Attributes {
+		b := o.Attributes[i]
+		if a.Name != b.Name || a.Value != b.Value {
+			return false
+		}
+	}
+
+	return true
 }
 
 /* Stringification routines */
@@ -575,58 +2622,247 @@ func (c Cfg) String() (out string) {
 	return
 }
 
+// StableString returns the cfg's emitted form, which is deterministic for a given cfg and set of emit options.
+// Records, tuples, and attributes are emitted in slice order, never in map order, and Load parses lines sequentially.
+func (c Cfg) StableString() string {
+	return c.String()
+}
+
 func (r Record) String() (out string) {
-	out += r.Tuples[0].String() + "\n"
+	out += r.Tuples[0].String() + LineEnding
 
 	if len(r.Tuples) > 1 {
 		for _, t := range r.Tuples[1:] {
-			out += "	" + t.String() + "\n"
+			out += t.indentation() + t.String() + LineEnding
+		}
+	}
+
+	return
+}
+
+// Leading whitespace emitted before a tuple in the body of a record, as loaded if kept
+func (t Tuple) indentation() string {
+	if t.indent == "" {
+		return "\t"
+	}
+
+	return t.indent
+}
+
+// DebugTree returns an indented tree of the cfg's records, tuples, and attributes for inspecting structure.
+func (c Cfg) DebugTree() (out string) {
+	for _, r := range c.Records {
+		out += "record " + r.PrimaryKey() + "\n"
+		for _, t := range r.Tuples {
+			out += "	tuple " + t.PrimaryKey() + "\n"
+			for _, a := range t.Attributes {
+				out += "		attr " + a.Name
+				if a.Value != "" {
+					out += "=" + a.Value
+				}
+				out += "\n"
+			}
+		}
+	}
+
+	return
+}
+
+// Display returns a human-readable rendering of the record with one 'name: value' line per attribute.
+// Valueless attributes are shown as just their name. The result is not a valid cfg.
+func (r Record) Display() (out string) {
+	for _, t := range r.Tuples {
+		for _, a := range t.Attributes {
+			out += a.Name
+			if a.Value != "" {
+				out += ": " + a.Value
+			}
+			out += "\n"
 		}
 	}
 
 	return
 }
 
+// Inline returns the record on a single line for logging, as in 'key: a=1 b=2 | sub: c=3'.
+// Each tuple is its primary attribute, a colon, and its other attributes, with tuples separated by ' | '.
+// Valueless names are shown without '=', comments are omitted, and the result is not a valid cfg.
+func (r Record) Inline() string {
+	var tuples []string
+	str := func(a *Attribute) string {
+		if a.Value == "" && !a.QuotedEmpty {
+			// Valueless names are shown without '='
+			return Quote(a.Name)
+		}
+		return a.String()
+	}
+
+	for _, t := range r.Tuples {
+		if len(t.Attributes) < 1 {
+			continue
+		}
+
+		s := str(t.Attributes[0])
+		if len(t.Attributes) > 1 {
+			var rest []string
+			for _, a := range t.Attributes[1:] {
+				rest = append(rest, str(a))
+			}
+			s += ": " + strings.Join(rest, " ")
+		}
+
+		tuples = append(tuples, s)
+	}
+
+	return strings.Join(tuples, " | ")
+}
+
 func (t Tuple) String() (out string) {
-	for _, a := range t.Attributes {
-		out += a.String() + " "
+	attrs := t.Attributes
+	if SortAttributes && len(attrs) > 1 {
+		// The primary key stays where it keys the tuple
+		primary := t.primary()
+		var rest Attributes
+		pos := 0
+		for i, a := range attrs {
+			if a == primary {
+				pos = i
+				continue
+			}
+			rest = append(rest, a)
+		}
+		sort.SliceStable(rest, func(i, j int) bool {
+			return rest[i].Name < rest[j].Name
+		})
+
+		attrs = append(append(append(Attributes{}, rest[:pos]...), primary), rest[pos:]...)
+	}
+
+	if t.Split != "" && len(attrs) > 1 {
+		// Rejoin the primary key to every other name
+		var joined Attributes
+		for _, a := range attrs[1:] {
+			ac := *a
+			ac.Name = attrs[0].Name + t.Split + a.Name
+			joined = append(joined, &ac)
+		}
+		attrs = joined
+	}
+
+	var comments []string
+	for i, a := range attrs {
+		out += a.String() + a.separator(i == len(attrs)-1)
+		if a.Comment != "" {
+			comments = append(comments, a.Comment)
+		}
+	}
+
+	if len(comments) > 0 {
+		out += "# " + strings.Join(comments, " ")
 	}
 	return
 }
 
 func (a Attribute) String() (out string) {
-	var quote rune
-	switch Quoting {
-	case Double:
-		quote = '"'
-	case Single:
-		quote = '\''
-	default:
-		quote = '"'
+	if a.unedited() {
+		// Unedited since loaded
+		return a.Raw
 	}
-	sq := string(quote)
 
-	nf := strings.Fields(a.Name)
-	if len(nf) > 1 {
-		// Quote it
-		out += sq + strings.ReplaceAll(a.Name, sq, sq+sq) + sq
-	} else {
-		out += a.Name
+	out += Quote(a.Name)
+
+	switch {
+	case a.Value == "" && a.QuotedEmpty:
+		sq := string(quote())
+		return out + "=" + sq + sq
+	case a.Value == "" && OmitEmptyEquals:
+		return
 	}
 
-	out += "="
+	if contains(Base64Names, a.Name) {
+		a.Value = base64.RawStdEncoding.EncodeToString([]byte(a.Value))
+	}
 
-	vf := strings.Fields(a.Value)
-	if len(vf) > 1 {
-		// Quote it
-		out += sq + strings.ReplaceAll(a.Value, sq, sq+sq) + sq
-	} else {
-		out += a.Value
+	if EscapeControl {
+		a.Value = escapeControl(a.Value)
 	}
 
+	if AllowBackticks && strings.ContainsAny(a.Value, `"'`) && !strings.ContainsAny(a.Value, "`\r\n") {
+		return out + "=`" + a.Value + "`"
+	}
+
+	out += "=" + Quote(a.Value)
+
 	return
 }
 
+// Whether Raw holds the attribute as it is
+func (a Attribute) unedited() bool {
+	return a.Raw != "" && a.raw == (rawAttr{a.Name, a.Value, a.QuotedEmpty})
+}
+
+// Whitespace emitted after the attribute, as loaded if unedited, 'last' allows none at the end of a tuple
+func (a Attribute) separator(last bool) string {
+	if !a.unedited() || (a.sep == "" && (!last || a.Comment != "")) {
+		return " "
+	}
+
+	return a.sep
+}
+
+// Quote returns 's' quoted per the Quoting mode if it contains any whitespace, such as a tab,
+// a comment character, an '=', or a quote, or if it begins with a backtick while AllowBackticks is set.
+// Quotes of the chosen kind within 's' are doubled.
+func Quote(s string) string {
+	raw := AllowBackticks && strings.HasPrefix(s, "`")
+	if !raw && strings.IndexFunc(s, unicode.IsSpace) < 0 && !strings.ContainsAny(s, `#='"`) {
+		return s
+	}
+
+	sq := string(quote())
+	return sq + strings.ReplaceAll(s, sq, sq+sq) + sq
+}
+
+// Unquote removes the surrounding quotes from 's', if any, and collapses doubled quotes within.
+func Unquote(s string) (string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return s, nil
+	}
+
+	q := rune(s[0])
+	var out strings.Builder
+	rs := []rune(s[1:])
+	for i := 0; i < len(rs); i++ {
+		if rs[i] != q {
+			out.WriteRune(rs[i])
+			continue
+		}
+
+		switch {
+		case i+1 < len(rs) && rs[i+1] == q:
+			// Literal quote
+			out.WriteRune(q)
+			i++
+		case i+1 == len(rs):
+			return out.String(), nil
+		default:
+			return "", fmt.Errorf("unexpected quote (%c) in %s", q, s)
+		}
+	}
+
+	return "", fmt.Errorf("unterminated quote (%c) in %s", q, s)
+}
+
+// The quote rune for the Quoting mode
+func quote() rune {
+	switch Quoting {
+	case Single:
+		return '\''
+	default:
+		return '"'
+	}
+}
+
 func (s states) String() string {
 	switch s {
 	case name:
@@ -641,6 +2877,8 @@ func (s states) String() string {
 		return `"Begin`
 	case dquoteend:
 		return `"End`
+	case rawend:
+		return "`End"
 	case equals:
 		return "Equals"
 	default:
@@ -4,9 +4,19 @@
 package cfg
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
+	"text/template"
+	"time"
 )
 
 const (
@@ -217,3 +227,2936 @@ func TestQuoting(t *testing.T) {
 	// Guard?
 	Quoting = Double
 }
+
+// TestKeyByPrimaryValue checks if records can be keyed by their first value
+func TestKeyByPrimaryValue(t *testing.T) {
+	KeyByPrimaryValue = true
+	defer func() { KeyByPrimaryValue = false }()
+
+	in := "host=web01\n\tip=1.2.3.4\nhost=web02\n\tip=1.2.3.5\nforce=\n"
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	records, ok := c.Lookup("web01")
+	if !ok || len(records) != 1 {
+		t.Fatal("record keyed as 'web01' not found")
+	}
+
+	if ip := records[0].FlatMap()["ip"]; ip != "1.2.3.4" {
+		t.Error("incorrect ip for web01, got:", ip)
+	}
+
+	if _, ok := c.Lookup("host"); ok {
+		t.Error("records should not be keyed by name")
+	}
+
+	// Tuples are keyed by value as well
+	ip, ok := c.Map["web02"]["1.2.3.5"]["ip"]
+	if !ok || len(ip) < 1 || ip[0] != "1.2.3.5" {
+		t.Error("incorrect map entry for web02")
+	}
+
+	// Valueless primary attributes fall back to the name
+	if _, ok := c.Map["force"]; !ok {
+		t.Error("valueless record 'force' not found in map")
+	}
+}
+
+// TestPrimaries checks if the primary attributes of records are listed in order
+func TestPrimaries(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	exPrimaries := []Attribute{
+		{Name: "a", Value: "b"},
+		{Name: "sys", Value: "mysystem"},
+		{Name: "ipnet", Value: "house"},
+		{Name: "name", Value: "alice"},
+		{Name: "creds"},
+		{Name: "force"},
+		{Name: "c", Value: "d"},
+		{Name: "sentence", Value: "hello there"},
+		{Name: "sing", Value: "a b c"},
+		{Name: "quoted", Value: `she said "hello"`},
+		{Name: "test id", Value: "no"},
+		{Name: "use bob's code"},
+		{Name: "blank"},
+		{Name: "foo"},
+		{Name: "bar"},
+	}
+	primaries := c.Primaries()
+
+	if len(primaries) != len(exPrimaries) {
+		t.Fatal("mismatched primaries lengths, got", len(primaries))
+	}
+
+	for i, a := range primaries {
+		ex := exPrimaries[i]
+		if a.Name != ex.Name || a.Value != ex.Value {
+			t.Error("mismatched primary attribute, wanted", ex, "got", a)
+		}
+	}
+}
+
+// TestStrict checks if tuples without attributes are rejected in strict mode
+func TestStrict(t *testing.T) {
+	in := "a=b\n=\nc=d\n"
+
+	// Lenient mode discards the empty tuple
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	if n := len(c.Records); n != 2 {
+		t.Error("incorrect record count, got:", n)
+	}
+
+	Strict = true
+	defer func() { Strict = false }()
+
+	_, err = Load(strings.NewReader(in))
+	if err == nil {
+		t.Fatal("empty tuple was not rejected in strict mode")
+	}
+
+	if !strings.Contains(err.Error(), "line:rune of 2:") {
+		t.Error("error does not cite the offending line →", err)
+	}
+}
+
+// TestParseAttribute checks if single attributes parse like they do in a file
+func TestParseAttribute(t *testing.T) {
+	exAttrs := map[string]Attribute{
+		`a=b`:     {Name: "a", Value: "b"},
+		`"a b"=c`: {Name: "a b", Value: "c"},
+		`flag`:    {Name: "flag"},
+	}
+
+	for in, ex := range exAttrs {
+		a, err := ParseAttribute(in)
+		if err != nil {
+			t.Error("could not parse", in, "→", err)
+			continue
+		}
+
+		if a.Name != ex.Name || a.Value != ex.Value {
+			t.Error("mismatched attribute for", in, "wanted", ex, "got", a)
+		}
+	}
+
+	for _, in := range []string{`a=b c=d`, ``, `"unterminated`} {
+		if _, err := ParseAttribute(in); err == nil {
+			t.Error("expected an error parsing", in)
+		}
+	}
+}
+
+// TestSetAll checks if every instance of a name is updated in a record
+func TestSetAll(t *testing.T) {
+	in := "creds=\n\tmethod=basic\n\tbackup method=basic\n\tmethod=none trust=\n"
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	creds, ok := c.Lookup("creds")
+	if !ok {
+		t.Fatal("Record keyed as 'creds' not found")
+	}
+
+	if n := creds[0].SetAll("method", "secure"); n != 3 {
+		t.Error("incorrect count of changed attributes, got:", n)
+	}
+
+	for _, tuple := range creds[0].Tuples {
+		for _, a := range tuple.Attributes {
+			if a.Name == "method" && a.Value != "secure" {
+				t.Error("attribute was not updated:", a)
+			}
+		}
+	}
+
+	if _, ok := creds[0].FlatMap()["trust"]; !ok {
+		t.Error("unrelated attribute went missing")
+	}
+
+	method := creds[0].Map["backup"]["method"]
+	if len(method) < 1 || method[0] != "secure" {
+		t.Error("record map was not refreshed")
+	}
+}
+
+// TestRoundTrips checks if lossy emissions are detected
+func TestRoundTrips(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	if !c.RoundTrips() {
+		t.Error("sample file does not round-trip")
+	}
+
+	clean := Cfg{Records: Records{{Tuples: Tuples{{Attributes: Attributes{{Name: "k", Value: "some value"}}}}}}}
+	if !clean.RoundTrips() {
+		t.Error("clean cfg does not round-trip")
+	}
+
+	quoted := Cfg{Records: Records{{Tuples: Tuples{{Attributes: Attributes{{Name: "k", Value: `a"b`}}}}}}}
+	if !quoted.RoundTrips() {
+		t.Error("value with a quote does not round-trip")
+	}
+
+	bad := Cfg{Records: Records{{Tuples: Tuples{{Attributes: Attributes{{Name: "k", Value: "a\nb"}}}}}}}
+	if bad.RoundTrips() {
+		t.Error("value with a newline should not round-trip")
+	}
+}
+
+// TestExpand checks if ${name} references in values are interpolated
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"HOME": "/home/alice", "A": "foo", "B": "bar"}
+	o := DefaultOptions()
+	o.Expand = func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+
+	in := "paths dir=${HOME}/lib both=${A}${B} quoted=\"${A} ${B}\" missing=${NOPE}\n"
+	c, err := LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	exValues := map[string]string{
+		"dir":     "/home/alice/lib",
+		"both":    "foobar",
+		"quoted":  "foo bar",
+		"missing": "${NOPE}",
+	}
+	values := c.Records[0].FlatMap()
+	for name, ex := range exValues {
+		if v := values[name]; v != ex {
+			t.Error("incorrect expansion for", name, "wanted", ex, "got", v)
+		}
+	}
+
+	o.ExpandStrict = true
+	if _, err := LoadWith(strings.NewReader(in), o); err == nil {
+		t.Error("unresolved variable did not error in strict expansion")
+	}
+}
+
+// TestSelectTuples checks if tuples are selected across records
+func TestSelectTuples(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	tuples := c.SelectTuples(func(t *Tuple) bool {
+		return strings.HasPrefix(t.PrimaryKey(), "s")
+	})
+
+	exKeys := []string{"sys", "sentence", "sing"}
+	if len(tuples) != len(exKeys) {
+		t.Fatal("incorrect tuple count, got:", len(tuples))
+	}
+
+	for i, tuple := range tuples {
+		if k := tuple.PrimaryKey(); k != exKeys[i] {
+			t.Error("mismatched primary keys, wanted", exKeys[i], "got", k)
+		}
+	}
+}
+
+// TestDepth checks if the indentation of tuples is recorded
+func TestDepth(t *testing.T) {
+	in := "a=b\n\tc=d\n\t\te=f\n    g=h\n"
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if n := len(c.Records); n != 1 {
+		t.Fatal("incorrect record count, got:", n)
+	}
+
+	exDepths := []int{0, 1, 2, 4}
+	tuples := c.Records[0].Tuples
+	if len(tuples) != len(exDepths) {
+		t.Fatal("incorrect tuple count, got:", len(tuples))
+	}
+
+	for i, tuple := range tuples {
+		if tuple.Depth != exDepths[i] {
+			t.Error("incorrect depth for", tuple.PrimaryKey(), "wanted", exDepths[i], "got", tuple.Depth)
+		}
+	}
+}
+
+// TestDisplay checks the human-readable rendering of a record
+func TestDisplay(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	creds, ok := c.Lookup("creds")
+	if !ok {
+		t.Fatal("Record keyed as 'creds' not found")
+	}
+
+	ex := "creds\nusername: foo\npass: bar\nmethod: basic\ntrust\nknown\n"
+	if s := creds[0].Display(); s != ex {
+		t.Error("incorrect display, got:", s)
+	}
+}
+
+// TestCollapseWhitespace checks if whitespace runs in values are folded
+func TestCollapseWhitespace(t *testing.T) {
+	in := "k=\"a   b \t c\" other='x  y'\n"
+
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if v := c.Records[0].FlatMap()["k"]; v != "a   b \t c" {
+		t.Error("whitespace was altered without the option, got:", v)
+	}
+
+	o := DefaultOptions()
+	o.CollapseWhitespace = true
+	c, err = LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	values := c.Records[0].FlatMap()
+	if v := values["k"]; v != "a b c" {
+		t.Error("incorrect collapsed value, got:", v)
+	}
+	if v := values["other"]; v != "x y" {
+		t.Error("incorrect collapsed value, got:", v)
+	}
+}
+
+// Generate a cfg with 'n' records of several tuples each
+func genCfg(n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "host=web%d dom=web%d.local ether=9212335b21fd\n", i, i)
+		fmt.Fprintf(&sb, "\tip=1.2.%d.%d ipmask=255.255.255.0\n", i/256%256, i%256)
+		sb.WriteString("\tauth='auth server' authdom=HOME # Comment\n")
+		sb.WriteString("\tflag \"quoted name\"=\"quoted \"\"value\"\"\"\n\n")
+	}
+	return sb.String()
+}
+
+func benchmarkLoad(b *testing.B, in string) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		if _, err := Load(strings.NewReader(in)); err != nil {
+			b.Fatal("could not load →", err)
+		}
+	}
+}
+
+// BenchmarkLoadSmall measures loading a handful of records
+func BenchmarkLoadSmall(b *testing.B) {
+	benchmarkLoad(b, genCfg(10))
+}
+
+// BenchmarkLoadLarge measures loading many records
+func BenchmarkLoadLarge(b *testing.B) {
+	benchmarkLoad(b, genCfg(5000))
+}
+
+// BenchmarkEmit measures emitting many records
+func BenchmarkEmit(b *testing.B) {
+	c, err := Load(strings.NewReader(genCfg(5000)))
+	if err != nil {
+		b.Fatal("could not load →", err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Emit(io.Discard)
+	}
+}
+
+// BenchmarkLookupIndexed measures lookups using the index
+func BenchmarkLookupIndexed(b *testing.B) {
+	c, err := Load(strings.NewReader(genCfg(5000)))
+	if err != nil {
+		b.Fatal("could not load →", err)
+	}
+	c.Index()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Lookup("host")
+	}
+}
+
+// BenchmarkLookupLinear measures lookups scanning every record
+func BenchmarkLookupLinear(b *testing.B) {
+	c, err := Load(strings.NewReader(genCfg(5000)))
+	if err != nil {
+		b.Fatal("could not load →", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.lookup("host")
+	}
+}
+
+// TestEqualUnordered checks if repeated values compare regardless of order
+func TestEqualUnordered(t *testing.T) {
+	a, err := Load(strings.NewReader("ipnet=house\n\tdns=1.1.1.1\n\tdns=8.8.8.8 known\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	b, err := Load(strings.NewReader("ipnet=house known\n\tdns=8.8.8.8\n\tdns=1.1.1.1\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if a.Records[0].Equal(b.Records[0]) {
+		t.Error("reordered records should not be strictly equal")
+	}
+
+	if !a.Records[0].EqualUnordered(b.Records[0]) {
+		t.Error("reordered records should be equal regardless of order")
+	}
+
+	b.Records[0].SetAll("dns", "9.9.9.9")
+	if a.Records[0].EqualUnordered(b.Records[0]) {
+		t.Error("records with different values should not be equal")
+	}
+}
+
+// TestParseRecord checks if single records parse like they do in a file
+func TestParseRecord(t *testing.T) {
+	r, err := ParseRecord("name=alice age=26\n")
+	if err != nil {
+		t.Fatal("could not parse single-line record →", err)
+	}
+
+	if k := r.PrimaryKey(); k != "name" || len(r.Tuples) != 1 {
+		t.Error("incorrect single-line record:", r)
+	}
+
+	r, err = ParseRecord("creds=\n\tusername=foo\n\tpass=bar\n")
+	if err != nil {
+		t.Fatal("could not parse multi-tuple record →", err)
+	}
+
+	if k := r.PrimaryKey(); k != "creds" || len(r.Tuples) != 3 {
+		t.Error("incorrect multi-tuple record:", r)
+	}
+
+	if _, err := ParseRecord("a=b\nc=d\n"); err == nil {
+		t.Error("expected an error parsing two records")
+	}
+
+	if _, err := ParseRecord("# Nothing\n"); err == nil {
+		t.Error("expected an error parsing zero records")
+	}
+}
+
+// TestOmitEmptyEquals checks if empty values are emitted as valueless names
+func TestOmitEmptyEquals(t *testing.T) {
+	c := Cfg{Records: Records{{Tuples: Tuples{{Attributes: Attributes{
+		{Name: "flag"},
+		{Name: "k", Value: "v"},
+		{Name: "empty", QuotedEmpty: true},
+	}}}}}}
+
+	var sb strings.Builder
+	c.Emit(&sb)
+	if s := sb.String(); !strings.HasPrefix(s, `flag= k=v empty=""`) {
+		t.Error("incorrect emission without the option, got:", s)
+	}
+
+	OmitEmptyEquals = true
+	defer func() { OmitEmptyEquals = false }()
+
+	sb.Reset()
+	c.Emit(&sb)
+	if s := sb.String(); !strings.HasPrefix(s, `flag k=v empty=""`) {
+		t.Error("incorrect emission with the option, got:", s)
+	}
+
+	if !c.RoundTrips() {
+		t.Error("emission without equals does not round-trip")
+	}
+}
+
+// TestSameKeys checks if primary key sets compare regardless of order
+func TestSameKeys(t *testing.T) {
+	a, err := Load(strings.NewReader("a=b\nsys=x\n\tip=1\nforce=\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	b, err := Load(strings.NewReader("force=\nsys=y\na=c\nsys=z\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	c, err := Load(strings.NewReader("a=b\nsys=x\nother=\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if !a.SameKeys(b) || !b.SameKeys(a) {
+		t.Error("reordered keys should be the same")
+	}
+
+	if a.SameKeys(c) || c.SameKeys(a) {
+		t.Error("differing keys should not be the same")
+	}
+}
+
+// TestLookupLast checks if the last of duplicate records is found
+func TestLookupLast(t *testing.T) {
+	path := "./users.cfg"
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	r, ok := c.LookupLast("name")
+	if !ok {
+		t.Fatal("Record keyed as 'name' not found")
+	}
+
+	if v := r.FlatMap()["name"]; v != "noone" {
+		t.Error("incorrect last record, got:", v)
+	}
+
+	if _, ok := c.LookupLast("missing"); ok {
+		t.Error("found a record for a missing key")
+	}
+}
+
+// TestLineEnding checks if CRLF emission loads back losslessly
+func TestLineEnding(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	LineEnding = "\r\n"
+	defer func() { LineEnding = "\n" }()
+
+	var sb strings.Builder
+	c.Emit(&sb)
+	s := sb.String()
+
+	if n, crlf := strings.Count(s, "\n"), strings.Count(s, "\r\n"); n != crlf {
+		t.Error("not every line ends in CRLF")
+	}
+
+	after, err := Load(strings.NewReader(s))
+	if err != nil {
+		t.Fatal("could not load CRLF emission →", err)
+	}
+
+	if !c.Equal(after) {
+		t.Error("CRLF emission did not load back equal")
+	}
+}
+
+// TestDistinctValues checks if every unique value of a name is found
+func TestDistinctValues(t *testing.T) {
+	path := "./users.cfg"
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	exValues := map[string][]string{
+		"name":  {"alice", "bob", "noone"},
+		"age":   {"23", "28", "42"},
+		"users": nil,
+	}
+
+	for name, ex := range exValues {
+		values := c.DistinctValues(name)
+		if len(values) != len(ex) {
+			t.Error("incorrect values for", name, "got:", values)
+			continue
+		}
+
+		for i := range values {
+			if values[i] != ex[i] {
+				t.Error("mismatched values for", name, "wanted", ex[i], "got", values[i])
+			}
+		}
+	}
+}
+
+// TestDebugTree checks the structural rendering of a cfg
+func TestDebugTree(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	tree := c.DebugTree()
+	exLines := []string{
+		"record ipnet\n\ttuple ipnet\n\t\tattr ipnet=house\n",
+		"\ttuple auth\n\t\tattr auth=1.2.3.4\n\t\tattr authdom=HOME\n",
+		"record blank\n\ttuple blank\n\t\tattr blank\n",
+	}
+
+	for _, ex := range exLines {
+		if !strings.Contains(tree, ex) {
+			t.Error("tree is missing:", ex)
+		}
+	}
+}
+
+// TestInferSeparator checks if space-separated names and values pair up
+func TestInferSeparator(t *testing.T) {
+	in := "key value  other \"quoted value\" flag= next a b=c last\n"
+	o := DefaultOptions()
+	o.InferSeparator = true
+	c, err := LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	exAttrs := []Attribute{
+		{Name: "key", Value: "value"},
+		{Name: "other", Value: "quoted value"},
+		{Name: "flag"},
+		{Name: "next", Value: "a"},
+		{Name: "b", Value: "c"},
+		{Name: "last"},
+	}
+	attrs := c.Records[0].Tuples[0].Attributes
+
+	if len(attrs) != len(exAttrs) {
+		t.Fatal("incorrect attribute count, got:", attrs)
+	}
+
+	for i, a := range attrs {
+		if ex := exAttrs[i]; a.Name != ex.Name || a.Value != ex.Value {
+			t.Error("mismatched attribute, wanted", ex, "got", a)
+		}
+	}
+
+	// Without the option every token is a name
+	c, err = Load(strings.NewReader("key value\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if n := len(c.Records[0].Tuples[0].Attributes); n != 2 {
+		t.Error("incorrect attribute count without the option, got:", n)
+	}
+}
+
+// TestPartition checks if records are grouped by an attribute's value
+func TestPartition(t *testing.T) {
+	in := "sys=a env=prod\nsys=b\n\tenv=dev\nsys=c env=prod\nforce=\n"
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	parts := c.Partition("env")
+	if n := len(parts); n != 3 {
+		t.Fatal("incorrect partition count, got:", n)
+	}
+
+	exCounts := map[string]int{"prod": 2, "dev": 1, "": 1}
+	for v, n := range exCounts {
+		part, ok := parts[v]
+		if !ok {
+			t.Error("missing partition:", v)
+			continue
+		}
+
+		if len(part.Records) != n {
+			t.Error("incorrect record count for partition", v, "got:", len(part.Records))
+		}
+	}
+
+	if _, ok := parts["dev"].Map["sys"]; !ok {
+		t.Error("partition map was not built")
+	}
+
+	if _, ok := parts[""].Map["force"]; !ok {
+		t.Error("record without the attribute is not in the empty partition")
+	}
+}
+
+// TestMaps checks if the map is only rebuilt when invalidated
+func TestMaps(t *testing.T) {
+	c, err := Load(strings.NewReader("sys=a\n\tip=1\nsys2=b\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	r := c.Records[0]
+	for i := 0; i < 100; i++ {
+		r.Tuples[1].Attributes[0].Value = fmt.Sprint(i)
+		c.Invalidate()
+	}
+
+	// The map is stale until requested
+	if ip := c.Map["sys"]["ip"]["ip"]; len(ip) < 1 || ip[0] != "1" {
+		t.Error("map was rebuilt eagerly, got:", ip)
+	}
+
+	m := c.Maps()
+	if ip := m["sys"]["ip"]["ip"]; len(ip) < 1 || ip[0] != "99" {
+		t.Error("map was not rebuilt, got:", ip)
+	}
+
+	// A clean map is returned as-is
+	m["sentinel"] = nil
+	if _, ok := c.Maps()["sentinel"]; !ok {
+		t.Error("clean map was rebuilt")
+	}
+
+	// A cfg built by hand has its map built on demand
+	built := Cfg{Records: c.Records}
+	if _, ok := built.Maps()["sys2"]; !ok {
+		t.Error("unbuilt map was not built")
+	}
+
+	// Mutators mark the map stale and discard the index, Maps rebuilds it
+	mutators := map[string]func(c *Cfg){
+		"ReorderLike":        func(c *Cfg) { c.ReorderLike(&Cfg{Records: c.Records[1:]}) },
+		"MoveTuple":          func(c *Cfg) { c.MoveTuple("sys", 1, "sys2") },
+		"RewriteValues":      func(c *Cfg) { c.RewriteValues(regexp.MustCompile("1"), "2") },
+		"PruneEmpty":         func(c *Cfg) { c.PruneEmpty() },
+		"MergeDuplicates":    func(c *Cfg) { c.MergeDuplicates() },
+		"NormalizeValueless": func(c *Cfg) { c.NormalizeValueless() },
+		"AppendRecordWithTimestamp": func(c *Cfg) {
+			c.AppendRecordWithTimestamp(&Record{Tuples: Tuples{{Attributes: Attributes{{Name: "log"}}}}}, time.Now())
+		},
+	}
+	for name, mutate := range mutators {
+		c, err := Load(strings.NewReader("sys=a\n\tip=1\nsys2=b\n"))
+		if err != nil {
+			t.Fatal("could not load →", err)
+		}
+		c.Index()
+
+		mutate(&c)
+		if !c.dirty || c.index != nil {
+			t.Error(name, "did not invalidate the map and index")
+		}
+
+		m := c.Maps()
+		if c.dirty || fmt.Sprint(m) != fmt.Sprint(c.BuildMap()) {
+			t.Error(name, "map was not rebuilt on demand")
+		}
+	}
+}
+
+// TestQuote checks if strings round-trip through Quote and Unquote
+func TestQuote(t *testing.T) {
+	exQuoted := map[string]string{
+		`plain`:              `plain`,
+		`hello there`:        `"hello there"`,
+		`she said "hi" once`: `"she said ""hi"" once"`,
+		`alice's tuple`:      `"alice's tuple"`,
+		`a=b`:                `"a=b"`,
+		`it's`:               `"it's"`,
+	}
+
+	for _, mode := range []Quotation{Double, Single} {
+		Quoting = mode
+		for in, ex := range exQuoted {
+			q := Quote(in)
+			if mode == Double && q != ex {
+				t.Error("incorrect quoting of", in, "wanted", ex, "got", q)
+			}
+
+			s, err := Unquote(q)
+			if err != nil {
+				t.Error("could not unquote", q, "→", err)
+			}
+			if s != in {
+				t.Error("mismatched round-trip, wanted", in, "got", s)
+			}
+		}
+	}
+	Quoting = Double
+
+	if s, err := Unquote(`'alice''s comment'`); err != nil || s != "alice's comment" {
+		t.Error("incorrect unquoting of a literal quote, got:", s, err)
+	}
+
+	for _, bad := range []string{`"unterminated`, `"a"b"`} {
+		if _, err := Unquote(bad); err == nil {
+			t.Error("expected an error unquoting", bad)
+		}
+	}
+}
+
+// TestRecordOf checks if a tuple's record is found
+func TestRecordOf(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	tuples := c.SelectTuples(func(t *Tuple) bool {
+		_, ok := t.Lookup("authdom")
+		return ok && t.PrimaryKey() == "auth"
+	})
+	if len(tuples) != 1 {
+		t.Fatal("incorrect tuple count, got:", len(tuples))
+	}
+
+	r, ok := c.RecordOf(tuples[0])
+	if !ok {
+		t.Fatal("record of tuple not found")
+	}
+
+	if k := r.PrimaryKey(); k != "ipnet" {
+		t.Error("incorrect record for tuple, got:", k)
+	}
+
+	// An equal tuple which isn't part of the cfg
+	if _, ok := c.RecordOf(&Tuple{Attributes: tuples[0].Attributes}); ok {
+		t.Error("found a record for a foreign tuple")
+	}
+}
+
+// TestWithDefaults checks if missing values are served from defaults
+func TestWithDefaults(t *testing.T) {
+	c, err := Load(strings.NewReader("server=web\n\tport=8080\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	defaults, err := Load(strings.NewReader("server=default\n\tport=80\n\ttimeout=30\nlog level=info\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	l := c.WithDefaults(&defaults)
+
+	exValues := map[[2]string]string{
+		{"server", "server"}:  "web",
+		{"server", "port"}:    "8080",
+		{"server", "timeout"}: "30",
+		{"log", "level"}:      "info",
+	}
+
+	for q, ex := range exValues {
+		v, ok := l.Get(q[0], q[1])
+		if !ok || v != ex {
+			t.Error("incorrect value for", q, "wanted", ex, "got", v)
+		}
+	}
+
+	if _, ok := l.Get("server", "missing"); ok {
+		t.Error("found a value for a missing attribute")
+	}
+}
+
+// TestEmitDelta checks if only changed and new records are emitted
+func TestEmitDelta(t *testing.T) {
+	baseline, err := Load(strings.NewReader("a=b\nsys=x\n\tip=1\nname=alice\nname=bob\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	c, err := Load(strings.NewReader("a=b\nsys=x\n\tip=2\nname=alice\nname=bob\nnew=\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	var sb strings.Builder
+	if err := c.EmitDelta(&sb, baseline); err != nil {
+		t.Fatal("could not emit delta →", err)
+	}
+
+	delta, err := Load(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal("could not load delta →", err)
+	}
+
+	exKeys := []string{"sys", "new"}
+	keys := delta.Keys()
+	if len(keys) != len(exKeys) {
+		t.Fatal("incorrect delta keys, got:", keys)
+	}
+
+	for i := range keys {
+		if keys[i] != exKeys[i] {
+			t.Error("mismatched primary keys, wanted", exKeys[i], "got", keys[i])
+		}
+	}
+}
+
+// TestMeta checks if metadata is copied but never emitted
+func TestMeta(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	creds, ok := c.Lookup("creds")
+	if !ok {
+		t.Fatal("Record keyed as 'creds' not found")
+	}
+
+	pass, _ := creds[0].Tuples[2].Lookup("pass")
+	pass[0].SetMeta("secret", "true")
+
+	clone := c.Clone()
+	if !clone.Equal(c) {
+		t.Error("clone is not equal to the original")
+	}
+
+	cloned, _ := clone.Lookup("creds")
+	cpass, _ := cloned[0].Tuples[2].Lookup("pass")
+	if cpass[0] == pass[0] || cpass[0].Meta["secret"] != "true" {
+		t.Error("metadata was not copied by clone")
+	}
+
+	// Clones don't share metadata
+	cpass[0].SetMeta("secret", "false")
+	if pass[0].Meta["secret"] != "true" {
+		t.Error("clone shares metadata with the original")
+	}
+
+	var sb strings.Builder
+	c.Emit(&sb)
+	if strings.Contains(sb.String(), "secret") {
+		t.Error("metadata was emitted")
+	}
+
+	after, err := Load(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal("could not load emission →", err)
+	}
+
+	reloaded, _ := after.Lookup("creds")
+	rpass, _ := reloaded[0].Tuples[2].Lookup("pass")
+	if rpass[0].Meta != nil {
+		t.Error("metadata survived a round-trip")
+	}
+}
+
+// TestDoubleQuoteEscaping checks both interpretations of doubled quotes
+func TestDoubleQuoteEscaping(t *testing.T) {
+	in := "k='a''b' d=\"x\"\"y\"\n"
+
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	values := c.Records[0].FlatMap()
+	if v := values["k"]; v != "a'b" {
+		t.Error("incorrect escaped value, got:", v)
+	}
+	if v := values["d"]; v != `x"y` {
+		t.Error("incorrect escaped value, got:", v)
+	}
+
+	o := DefaultOptions()
+	o.DoubleQuoteEscaping = false
+	c, err = LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	// The quote closes and a new quoted name begins
+	exAttrs := []Attribute{
+		{Name: "k", Value: "a"},
+		{Name: "b"},
+		{Name: "d", Value: "x"},
+		{Name: "y"},
+	}
+	attrs := c.Records[0].Tuples[0].Attributes
+	if len(attrs) != len(exAttrs) {
+		t.Fatal("incorrect attribute count, got:", attrs)
+	}
+
+	for i, a := range attrs {
+		if ex := exAttrs[i]; a.Name != ex.Name || a.Value != ex.Value {
+			t.Error("mismatched attribute, wanted", ex, "got", a)
+		}
+	}
+}
+
+// TestFilter checks if attributes are filtered by a predicate
+func TestFilter(t *testing.T) {
+	r, err := ParseRecord("sys=mysystem dom=mysystem.local ether=9212335b21fd authdom=HOME auth=1.2.3.4\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	attrs := r.Tuples[0].Attributes.Filter(func(a *Attribute) bool {
+		return strings.HasPrefix(a.Name, "auth")
+	})
+
+	exNames := []string{"authdom", "auth"}
+	if len(attrs) != len(exNames) {
+		t.Fatal("incorrect attribute count, got:", attrs)
+	}
+
+	for i, a := range attrs {
+		if a.Name != exNames[i] {
+			t.Error("mismatched names, wanted", exNames[i], "got", a.Name)
+		}
+	}
+}
+
+// TestReorderLike checks if records are reordered to match a reference
+func TestReorderLike(t *testing.T) {
+	reference, err := Load(strings.NewReader("a=\nb=\nc=\nd=\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	c, err := Load(strings.NewReader("extra=1\nc=1\na=1\nb=1\nc=2\nother=1\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	c.ReorderLike(&reference)
+
+	exOrder := []string{"a=1", "b=1", "c=1", "c=2", "extra=1", "other=1"}
+	if len(c.Records) != len(exOrder) {
+		t.Fatal("incorrect record count, got:", len(c.Records))
+	}
+
+	for i, r := range c.Records {
+		if s := r.Tuples[0].Attributes[0].String(); s != exOrder[i] {
+			t.Error("mismatched order, wanted", exOrder[i], "got", s)
+		}
+	}
+
+	if _, ok := c.Maps()["other"]; !ok {
+		t.Error("map was not rebuilt")
+	}
+}
+
+// TestPrimaryValue checks if a primary key's value is available
+func TestPrimaryValue(t *testing.T) {
+	c, err := Load(strings.NewReader("sys=web01\n\tip=1.2.3.4\nforce=\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	sys, force := c.Records[0], c.Records[1]
+	if k, v := sys.PrimaryKey(), sys.PrimaryValue(); k != "sys" || v != "web01" {
+		t.Error("incorrect primary key and value, got:", k, v)
+	}
+
+	if !sys.HasKeyedValue() {
+		t.Error("sys should have a keyed value")
+	}
+
+	if force.HasKeyedValue() || force.PrimaryValue() != "" {
+		t.Error("force should not have a keyed value")
+	}
+}
+
+// TestTyped checks if value types are inferred conservatively
+func TestTyped(t *testing.T) {
+	r, err := ParseRecord("svc=web port=8080 ratio=0.75 neg=-3 on=true off=false zip=007 ver=1.2.3 yes=True flag big=99999999999999999999\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	exValues := []interface{}{"web", int64(8080), 0.75, int64(-3), true, false, "007", "1.2.3", "True", nil, "99999999999999999999"}
+	typed := r.Tuples[0].Typed()
+	if len(typed) != len(exValues) {
+		t.Fatal("incorrect attribute count, got:", typed)
+	}
+
+	for i, a := range typed {
+		if a.Value != exValues[i] {
+			t.Error("incorrect inference for", a.Name, "wanted", exValues[i], "got", a.Value)
+		}
+	}
+}
+
+// TestGetLast checks if the last of repeated names wins
+func TestGetLast(t *testing.T) {
+	r, err := ParseRecord("level=1 level=2\n\tlevel=3 level=4 other=x\n\tflag\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	if v, ok := r.Tuples[0].GetLast("level"); !ok || v != "2" {
+		t.Error("incorrect last value in tuple, got:", v)
+	}
+
+	if v, ok := r.GetLast("level"); !ok || v != "4" {
+		t.Error("incorrect last value in record, got:", v)
+	}
+
+	if v, ok := r.GetLast("flag"); !ok || v != "" {
+		t.Error("incorrect last value for a valueless name, got:", v)
+	}
+
+	if _, ok := r.GetLast("missing"); ok {
+		t.Error("found a value for a missing name")
+	}
+}
+
+// TestFinalNewline checks each final newline policy
+func TestFinalNewline(t *testing.T) {
+	c, err := Load(strings.NewReader("a=b\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+	empty := Cfg{}
+
+	exOut := map[NewlinePolicy][2]string{
+		KeepNewline:  {"a=b \n", ""},
+		ForceNewline: {"a=b \n", "\n"},
+		StripNewline: {"a=b ", ""},
+	}
+
+	defer func() { FinalNewline = KeepNewline }()
+	for policy, ex := range exOut {
+		FinalNewline = policy
+
+		for i, cfg := range []Cfg{c, empty} {
+			var sb strings.Builder
+			cfg.Emit(&sb)
+			if s := sb.String(); s != ex[i] {
+				t.Error("incorrect emission for policy", policy, "wanted", ex[i], "got", s)
+			}
+		}
+	}
+}
+
+// TestUniformSchema checks if ragged records are detected
+func TestUniformSchema(t *testing.T) {
+	c, err := Load(strings.NewReader("host=a ip=1\n\tport=80\nhost=b port=81\n\tip=2\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if ok, _ := c.UniformSchema(); !ok {
+		t.Error("uniform records were not uniform")
+	}
+
+	c, err = Load(strings.NewReader("host=a ip=1\nhost=b port=81\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	ok, union := c.UniformSchema()
+	if ok {
+		t.Error("ragged records were uniform")
+	}
+
+	exNames := []string{"host", "ip", "port"}
+	if len(union) != len(exNames) {
+		t.Fatal("incorrect union, got:", union)
+	}
+
+	for i := range union {
+		if union[i] != exNames[i] {
+			t.Error("mismatched names, wanted", exNames[i], "got", union[i])
+		}
+	}
+}
+
+// TestFindTuple checks if tuples are found by a non-primary attribute
+func TestFindTuple(t *testing.T) {
+	r, err := ParseRecord("iface=eth\n\taddr=1.2.3.4 type=secondary\n\taddr=5.6.7.8 type=primary\n\taddr=9.9.9.9 type=primary\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	tuple, ok := r.FindTuple("type", "primary")
+	if !ok {
+		t.Fatal("tuple with type=primary not found")
+	}
+
+	if tuple != r.Tuples[2] {
+		t.Error("incorrect tuple found:", tuple)
+	}
+
+	if _, ok := r.FindTuple("type", "missing"); ok {
+		t.Error("found a tuple for a missing value")
+	}
+}
+
+// TestQuoteAfterEquals checks quotes which begin immediately after '='
+func TestQuoteAfterEquals(t *testing.T) {
+	exAttrs := map[string]Attribute{
+		`k="v"`:      {Name: "k", Value: "v"},
+		`k='v w'`:    {Name: "k", Value: "v w"},
+		`="v"`:       {Value: "v"},
+		`k=""`:       {Name: "k", QuotedEmpty: true},
+		`k=''`:       {Name: "k", QuotedEmpty: true},
+		`k=`:         {Name: "k"},
+		`"a b"=""`:   {Name: "a b", QuotedEmpty: true},
+		`k="""v"""`:  {Name: "k", Value: `"v"`},
+		`k='''v'''`:  {Name: "k", Value: `'v'`},
+		`k="a""b"`:   {Name: "k", Value: `a"b`},
+		`"n""m"="v"`: {Name: `n"m`, Value: "v"},
+	}
+
+	for in, ex := range exAttrs {
+		a, err := ParseAttribute(in)
+		if err != nil {
+			t.Error("could not parse", in, "→", err)
+			continue
+		}
+
+		if a.Name != ex.Name || a.Value != ex.Value || a.QuotedEmpty != ex.QuotedEmpty {
+			t.Error("mismatched attribute for", in, "wanted", ex, "got", *a)
+		}
+	}
+
+	// Explicitly empty values survive emission
+	c, err := Load(strings.NewReader("k=\"\" j=\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	var sb strings.Builder
+	c.Emit(&sb)
+	if s := sb.String(); !strings.HasPrefix(s, `k="" j= `) {
+		t.Error("incorrect emission of empty values, got:", s)
+	}
+
+	// A discarded empty attribute does not mark its predecessor
+	c, err = Load(strings.NewReader("rec flag =\"\"\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	for _, a := range c.Records[0].Tuples[0].Attributes {
+		if a.QuotedEmpty {
+			t.Error("attribute", a.Name, "marked as quoted empty")
+		}
+	}
+
+	sb.Reset()
+	c.Emit(&sb)
+	if s := sb.String(); strings.Contains(s, `""`) {
+		t.Error("discarded empty value was emitted, got:", s)
+	}
+}
+
+// TestHash checks if hashes follow content rather than formatting
+func TestHash(t *testing.T) {
+	a, err := Load(strings.NewReader("# Comment\nsys=web 'dom'=\"web.local\"\n\tip=1.2.3.4\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	b, err := Load(strings.NewReader("sys=web   dom=web.local # Trailing\n\n    ip='1.2.3.4'\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	c, err := Load(strings.NewReader("sys=web dom=web.local\n\tip=1.2.3.5\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	// Attributes shifted between tuples
+	d, err := Load(strings.NewReader("sys=web dom=web.local ip=1.2.3.4\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if a.Hash() != b.Hash() {
+		t.Error("equivalent cfgs hashed differently")
+	}
+
+	if a.Hash() == c.Hash() || a.Hash() == d.Hash() {
+		t.Error("different cfgs hashed equally")
+	}
+
+	// Attributes named like structure
+	e, err := Load(strings.NewReader("a=1\nb=2\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	f, err := Load(strings.NewReader("a=1 record=tuple b=2\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if e.Hash() == f.Hash() {
+		t.Error("attributes collided with record boundaries")
+	}
+}
+
+// TestSortAttributes checks if sorted emission is equivalent to the original
+func TestSortAttributes(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	SortAttributes = true
+	defer func() { SortAttributes = false }()
+
+	var sb strings.Builder
+	c.Emit(&sb)
+	s := sb.String()
+
+	if !strings.Contains(s, "sys=mysystem auth=1.2.3.4 authdom=HOME dom=mysystem.local ether=9212335b21fd ") {
+		t.Error("attributes were not sorted, got:", s)
+	}
+
+	after, err := Load(strings.NewReader(s))
+	if err != nil {
+		t.Fatal("could not load sorted emission →", err)
+	}
+
+	if len(after.Records) != len(c.Records) {
+		t.Fatal("mismatched record counts")
+	}
+
+	for i, r := range c.Records {
+		if !r.EqualUnordered(after.Records[i]) || r.PrimaryKey() != after.Records[i].PrimaryKey() {
+			t.Error("sorted record is not equivalent:", r)
+		}
+	}
+
+	// The primary key keeps its position when keyed by index
+	PrimaryKeyIndex = 1
+	defer func() { PrimaryKeyIndex = 0 }()
+
+	r, err := ParseRecord("z=1 host=web b=2 a=3\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+	if s := r.String(); s != "a=3 host=web b=2 z=1 \n" {
+		t.Error("primary key was not kept in place, got:", s)
+	}
+	PrimaryKeyIndex = 0
+
+	// The original order is untouched
+	if k := c.Records[1].Tuples[0].Attributes[1].Name; k != "dom" {
+		t.Error("sorting modified the cfg, got:", k)
+	}
+}
+
+// TestAppendAll checks if appended attributes are reflected in the map
+func TestAppendAll(t *testing.T) {
+	r, err := ParseRecord("creds=\n\tusername=foo\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	tuple := r.Tuples[1]
+	tuple.AppendAll(
+		Attribute{Name: "pass", Value: "bar"},
+		Attribute{Name: "method", Value: "basic"},
+		Attribute{Name: "trust"},
+	)
+
+	if n := len(tuple.Attributes); n != 4 {
+		t.Error("incorrect attribute count, got:", n)
+	}
+
+	exMap := map[string][]string{
+		"username": {"foo"},
+		"pass":     {"bar"},
+		"method":   {"basic"},
+		"trust":    {},
+	}
+	if len(tuple.Map) != len(exMap) {
+		t.Fatal("incorrect map, got:", tuple.Map)
+	}
+
+	for n, ex := range exMap {
+		values, ok := tuple.Map[n]
+		if !ok || len(values) != len(ex) || (len(ex) > 0 && values[0] != ex[0]) {
+			t.Error("incorrect map entry for", n, "got:", values)
+		}
+	}
+}
+
+// TestGeneric checks if the generic form works with text/template
+func TestGeneric(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	g := c.Generic()
+	ipnet := g["ipnet"].(map[string]interface{})
+	if ip, ok := ipnet["ip"].(string); !ok || ip != "1.2.3.0" {
+		t.Error("incorrect generic value for ipnet ip")
+	}
+
+	auth, ok := ipnet["auth"].(map[string]interface{})
+	if !ok || auth["auth"] != "1.2.3.4" || auth["authdom"] != "HOME" {
+		t.Error("incorrect generic sub-record for ipnet auth, got:", ipnet["auth"])
+	}
+
+	if _, ok := ipnet["authdom"]; ok {
+		t.Error("sub-record attributes were flattened into the record")
+	}
+
+	tmpl := template.Must(template.New("test").Parse(`{{.ipnet.auth.authdom}} {{.creds.username.username}} {{index .sentence "sentence"}}`))
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, g); err != nil {
+		t.Fatal("could not execute template →", err)
+	}
+
+	if s := sb.String(); s != "HOME foo hello there" {
+		t.Error("incorrect template output, got:", s)
+	}
+
+	users, err := Load(strings.NewReader("name=alice\nname=bob\n\tgroups=a\n\tgroups=b\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	names, ok := users.Generic()["name"].([]interface{})
+	if !ok || len(names) != 2 {
+		t.Fatal("records sharing a key were not collected")
+	}
+
+	groups, ok := names[1].(map[string]interface{})["groups"].([]interface{})
+	if !ok || len(groups) != 2 || groups[1].(map[string]interface{})["groups"] != "b" {
+		t.Error("tuples sharing a key were not collected")
+	}
+}
+
+// TestStrictValueless checks if names both with and without values are rejected in strict mode
+func TestStrictValueless(t *testing.T) {
+	in := "a=b\n\tx x=1\n\ty=1 y=2 z z\n"
+
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if x := c.Map["a"]["x"]["x"]; len(x) != 1 {
+		t.Error("lenient mode did not keep both attributes, got:", x)
+	}
+
+	Strict = true
+	defer func() { Strict = false }()
+
+	_, err = Load(strings.NewReader(in))
+	if err == nil {
+		t.Fatal("ambiguous name was not rejected in strict mode")
+	}
+
+	if msg := err.Error(); !strings.Contains(msg, "x") || !strings.Contains(msg, "line:rune of 2:") {
+		t.Error("error does not cite the name and line →", err)
+	}
+
+	if _, err := Load(strings.NewReader("a=b\n\ty=1 y=2 z z\n")); err != nil {
+		t.Error("consistent repeats were rejected →", err)
+	}
+}
+
+// TestMoveTuple checks if tuples move between records
+func TestMoveTuple(t *testing.T) {
+	c, err := Load(strings.NewReader("a=1\n\tx=1\n\ty=1\nb=2\n\tz=2\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if err := c.MoveTuple("a", 1, "b"); err != nil {
+		t.Fatal("could not move tuple →", err)
+	}
+
+	a, b := c.Records[0], c.Records[1]
+	if len(a.Tuples) != 2 || a.Tuples[1].PrimaryKey() != "y" {
+		t.Error("incorrect source record:", a)
+	}
+
+	if len(b.Tuples) != 3 || b.Tuples[2].PrimaryKey() != "x" {
+		t.Error("incorrect destination record:", b)
+	}
+
+	if _, ok := c.Maps()["b"]["x"]; !ok {
+		t.Error("map was not rebuilt")
+	}
+
+	for _, bad := range []struct {
+		from string
+		i    int
+		to   string
+	}{{"missing", 1, "b"}, {"a", 1, "missing"}, {"a", 2, "b"}, {"a", 0, "b"}, {"a", -1, "b"}} {
+		if err := c.MoveTuple(bad.from, bad.i, bad.to); err == nil {
+			t.Error("expected an error moving", bad)
+		}
+	}
+}
+
+// TestBackticks checks if backtick values are raw literals
+func TestBackticks(t *testing.T) {
+	in := "re=`^\"a b\" it's=='x'$` path=`C:\\dir` empty=`` plain=x`y\n"
+
+	o := DefaultOptions()
+	o.AllowBackticks = true
+	c, err := LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	exValues := map[string]string{
+		"re":    `^"a b" it's=='x'$`,
+		"path":  `C:\dir`,
+		"empty": "",
+		"plain": "x`y",
+	}
+	values := c.Records[0].FlatMap()
+	for name, ex := range exValues {
+		if v := values[name]; v != ex {
+			t.Error("incorrect value for", name, "wanted", ex, "got", v)
+		}
+	}
+
+	AllowBackticks = true
+	defer func() { AllowBackticks = false }()
+
+	var sb strings.Builder
+	c.Emit(&sb)
+	if s := sb.String(); !strings.HasPrefix(s, "re=`^\"a b\" it's=='x'$` ") {
+		t.Error("value was not emitted in backticks, got:", s)
+	}
+
+	after, err := Load(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal("could not load emission →", err)
+	}
+
+	if !c.Equal(after) {
+		t.Error("backtick emission did not load back equal")
+	}
+
+	if _, err := LoadWith(strings.NewReader("k=`open\n"), o); err == nil {
+		t.Error("unterminated backtick did not error")
+	}
+
+	// Values beginning with a backtick are quoted rather than read back as raw values
+	for _, v := range []string{"`x`", "`", "`a b"} {
+		c := Cfg{Records: Records{{Tuples: Tuples{{Attributes: Attributes{{Name: "k", Value: v}}}}}}}
+		if !c.RoundTrips() {
+			t.Error("value with a leading backtick does not round-trip:", c.String())
+		}
+	}
+}
+
+// TestHeadBody checks if a record splits into its head and body
+func TestHeadBody(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	ipnet, ok := c.Lookup("ipnet")
+	if !ok {
+		t.Fatal("Record keyed as 'ipnet' not found")
+	}
+	r := ipnet[0]
+
+	if h := r.Head(); h != r.Tuples[0] || h.PrimaryKey() != "ipnet" {
+		t.Error("incorrect head:", h)
+	}
+
+	exKeys := []string{"ipgw", "auth", "fs", "cpu", "dns"}
+	body := r.Body()
+	if len(body) != len(exKeys) {
+		t.Fatal("incorrect body length, got:", len(body))
+	}
+
+	for i, tuple := range body {
+		if k := tuple.PrimaryKey(); k != exKeys[i] {
+			t.Error("mismatched primary keys, wanted", exKeys[i], "got", k)
+		}
+	}
+
+	force, _ := c.Lookup("force")
+	if body := force[0].Body(); body != nil {
+		t.Error("single-tuple record has a body:", body)
+	}
+
+	if (&Record{}).Head() != nil {
+		t.Error("empty record has a head")
+	}
+}
+
+// TestValidator checks if a validator can reject a loaded cfg
+func TestValidator(t *testing.T) {
+	Validator = func(c Cfg) error {
+		for _, r := range c.Records {
+			if _, ok := r.FlatMap()["kind"]; !ok {
+				return errors.New("record " + r.PrimaryKey() + " has no kind")
+			}
+		}
+		return nil
+	}
+	defer func() { Validator = nil }()
+
+	if _, err := Load(strings.NewReader("a=1 kind=x\nb=2\n\tkind=y\n")); err != nil {
+		t.Error("valid cfg was rejected →", err)
+	}
+
+	_, err := Load(strings.NewReader("a=1 kind=x\nb=2\n"))
+	if err == nil || !strings.Contains(err.Error(), "record b") {
+		t.Error("invalid cfg was not rejected →", err)
+	}
+}
+
+// TestComment checks if trailing comments are kept with their attribute
+func TestComment(t *testing.T) {
+	in := "creds=\n\tuser=bob pass=secret # rotate monthly\n\tnote='a # b' \"c#d\"=e#f\n"
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	tuples := c.Records[0].Tuples
+	pass := tuples[1].Attributes[1]
+	if pass.Comment != "rotate monthly" || tuples[1].Attributes[0].Comment != "" {
+		t.Error("comment is not on the last attribute, got:", pass.Comment)
+	}
+
+	exAttrs := []Attribute{{Name: "note", Value: "a # b"}, {Name: "c#d", Value: "e", Comment: "f"}}
+	for i, a := range tuples[2].Attributes {
+		if ex := exAttrs[i]; a.Name != ex.Name || a.Value != ex.Value || a.Comment != ex.Comment {
+			t.Error("mismatched attribute, wanted", ex, "got", *a)
+		}
+	}
+
+	var sb strings.Builder
+	c.Emit(&sb)
+	if s := sb.String(); !strings.Contains(s, "pass=secret # rotate monthly\n") {
+		t.Error("comment was not emitted, got:", s)
+	}
+
+	after, err := Load(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal("could not load emission →", err)
+	}
+
+	if !after.Equal(c) || after.Records[0].Tuples[1].Attributes[1].Comment != "rotate monthly" {
+		t.Error("comment did not round-trip")
+	}
+}
+
+// TestEntries checks if entries pair keys with records in order
+func TestEntries(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	keys := c.Keys()
+	entries := c.Entries()
+	if len(entries) != len(keys) || len(entries) != len(c.Records) {
+		t.Fatal("mismatched entry count, got:", len(entries))
+	}
+
+	for i, e := range entries {
+		if e.Key != keys[i] || e.Record != c.Records[i] {
+			t.Error("mismatched entry", i, "got key", e.Key)
+		}
+	}
+}
+
+// TestSelect checks if only the chosen records are kept
+func TestSelect(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	s := c.Select("creds", "ipnet", "missing")
+
+	exKeys := []string{"ipnet", "creds"}
+	keys := s.Keys()
+	if len(keys) != len(exKeys) {
+		t.Fatal("incorrect keys, got:", keys)
+	}
+
+	for i := range keys {
+		if keys[i] != exKeys[i] {
+			t.Error("mismatched primary keys, wanted", exKeys[i], "got", keys[i])
+		}
+	}
+
+	if _, ok := s.Map["ipnet"]["auth"]; !ok {
+		t.Error("map was not built")
+	}
+
+	if len(c.Records) != nRecords {
+		t.Error("select modified the original cfg")
+	}
+}
+
+// TestFlatMapStrict checks if conflicting values are detected
+func TestFlatMapStrict(t *testing.T) {
+	r, err := ParseRecord("sys=web dom=local\n\tdom=local flag\n\tflag\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	m, err := r.FlatMapStrict()
+	if err != nil {
+		t.Fatal("identical repeats conflicted →", err)
+	}
+
+	if m["dom"] != "local" || len(m) != 3 {
+		t.Error("incorrect flat map:", m)
+	}
+
+	r, err = ParseRecord("sys=web dom=local\n\tdom=remote\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	if _, err := r.FlatMapStrict(); err == nil || !strings.Contains(err.Error(), "dom") {
+		t.Error("conflicting values were not reported →", err)
+	}
+}
+
+// TestSplitNames checks if dotted names nest into tuples and rejoin on emission
+func TestSplitNames(t *testing.T) {
+	in := "a.b.c=1\nsys=web auth.domain=HOME auth.server=1.2.3.4 dns=x\n\tlog.level=info\n"
+
+	o := DefaultOptions()
+	o.SplitNames = "."
+	c, err := LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if v := c.Map["a"]["a"]["b.c"]; len(v) != 1 || v[0] != "1" {
+		t.Error("incorrect nesting for a.b.c, got:", c.Map["a"])
+	}
+
+	if v := c.Map["sys"]["auth"]["domain"]; len(v) != 1 || v[0] != "HOME" {
+		t.Error("incorrect nesting for auth.domain, got:", c.Map["sys"])
+	}
+
+	if v := c.Map["sys"]["log"]["level"]; len(v) != 1 || v[0] != "info" {
+		t.Error("incorrect nesting for log.level, got:", c.Map["sys"])
+	}
+
+	exKeys := []string{"sys", "auth", "log"}
+	tuples := c.Records[1].Tuples
+	if len(tuples) != len(exKeys) {
+		t.Fatal("incorrect tuple count, got:", len(tuples))
+	}
+
+	for i, tuple := range tuples {
+		if k := tuple.PrimaryKey(); k != exKeys[i] {
+			t.Error("mismatched primary keys, wanted", exKeys[i], "got", k)
+		}
+	}
+
+	var sb strings.Builder
+	c.Emit(&sb)
+	s := sb.String()
+	for _, ex := range []string{"a.b.c=1 \n", "auth.domain=HOME auth.server=1.2.3.4 \n", "log.level=info \n"} {
+		if !strings.Contains(s, ex) {
+			t.Error("emission did not rejoin", ex, "got:", s)
+		}
+	}
+
+	after, err := LoadWith(strings.NewReader(s), o)
+	if err != nil {
+		t.Fatal("could not load emission →", err)
+	}
+
+	if !after.Equal(c) {
+		t.Error("split names did not round-trip")
+	}
+}
+
+// TestSetAttributes checks if replaced attributes are reflected in the map
+func TestSetAttributes(t *testing.T) {
+	r, err := ParseRecord("creds=\n\tusername=foo pass=bar\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	tuple := r.Tuples[1]
+	tuple.SetAttributes(Attributes{{Name: "token", Value: "abc"}, {Name: "trust"}})
+
+	if k := tuple.PrimaryKey(); k != "token" {
+		t.Error("incorrect primary key, got:", k)
+	}
+
+	if len(tuple.Map) != 2 {
+		t.Fatal("incorrect map, got:", tuple.Map)
+	}
+
+	if v := tuple.Map["token"]; len(v) != 1 || v[0] != "abc" {
+		t.Error("incorrect map entry for token, got:", v)
+	}
+
+	if v, ok := tuple.Map["trust"]; !ok || len(v) != 0 {
+		t.Error("incorrect map entry for trust, got:", v)
+	}
+
+	if _, ok := tuple.Map["username"]; ok {
+		t.Error("map kept a replaced attribute")
+	}
+}
+
+// TestEmitOrdered checks if records are emitted in a chosen order
+func TestEmitOrdered(t *testing.T) {
+	c, err := Load(strings.NewReader("a=1\nb=1\nc=1\nb=2\nd=1\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	var sb strings.Builder
+	if err := c.EmitOrdered(&sb, []string{"c", "missing", "b"}); err != nil {
+		t.Fatal("could not emit →", err)
+	}
+
+	ex := "c=1 \nb=1 \nb=2 \na=1 \nd=1 \n"
+	if s := sb.String(); s != ex {
+		t.Error("incorrect order, wanted", ex, "got", s)
+	}
+
+	// The cfg itself is untouched
+	if k := c.Keys()[0]; k != "a" {
+		t.Error("emission reordered the cfg")
+	}
+}
+
+// TestLoadVerbose checks if orphaned indented tuples are skipped as warnings
+func TestLoadVerbose(t *testing.T) {
+	in := "\torphan=1\nsys=a\n\tip=1\nsys=b\n"
+
+	if _, err := Load(strings.NewReader(in)); err == nil {
+		t.Fatal("expected Load to reject the orphaned tuple")
+	}
+
+	c, warnings, err := LoadVerbose(strings.NewReader(in), DefaultOptions())
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "line:rune of 1:") {
+		t.Error("expected one warning for line 1, got", warnings)
+	}
+
+	if len(c.Records) != 2 || len(c.Records[0].Tuples) != 2 {
+		t.Error("records following the orphan were not parsed →", c)
+	}
+}
+
+// TestNameUnion checks if names are collected across records sharing a key
+func TestNameUnion(t *testing.T) {
+	c, err := Load(strings.NewReader("host=a ip=1\n\tport=22\nhost=b ip=2 os=plan9\nother=c zone=x\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	ex := []string{"host", "ip", "os", "port"}
+	if names := c.NameUnion("host"); fmt.Sprint(names) != fmt.Sprint(ex) {
+		t.Error("incorrect union, wanted", ex, "got", names)
+	}
+
+	if names := c.NameUnion("missing"); len(names) != 0 {
+		t.Error("expected no names for a missing key, got", names)
+	}
+}
+
+// TestPrimaryKeyIndex checks if records can be keyed by a later attribute
+func TestPrimaryKeyIndex(t *testing.T) {
+	PrimaryKeyIndex = 1
+	defer func() { PrimaryKeyIndex = 0 }()
+
+	c, err := Load(strings.NewReader("type=host web01=1.2.3.4\ntype=host web02\nlone\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	ex := []string{"web01", "web02", "lone"}
+	if keys := c.Keys(); fmt.Sprint(keys) != fmt.Sprint(ex) {
+		t.Error("incorrect keys, wanted", ex, "got", keys)
+	}
+
+	if v := c.Records[0].PrimaryValue(); v != "1.2.3.4" {
+		t.Error("incorrect primary value, got", v)
+	}
+}
+
+// TestTupleEach checks if attributes can be edited in place while iterating
+func TestTupleEach(t *testing.T) {
+	r, err := ParseRecord("host=a ip=1.2.3.4 port=22\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	tuple := r.Tuples[0]
+	tuple.Rebuild()
+
+	var seen []int
+	tuple.Each(func(i int, a *Attribute) {
+		seen = append(seen, i)
+		if a.Name == "port" {
+			a.Value = "2222"
+		}
+	})
+	tuple.Rebuild()
+
+	if fmt.Sprint(seen) != "[0 1 2]" {
+		t.Error("incorrect indices visited:", seen)
+	}
+
+	if v := tuple.Map["port"]; len(v) != 1 || v[0] != "2222" {
+		t.Error("edit not reflected in the map:", tuple.Map)
+	}
+}
+
+// TestLoadMaybeGzip checks if gzipped and plain input load the same
+func TestLoadMaybeGzip(t *testing.T) {
+	in := "sys=a ip=1\n\tport=22\nsys=b\n"
+
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write([]byte(in))
+	zw.Close()
+
+	plain, err := LoadMaybeGzip(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not load plain input →", err)
+	}
+
+	unzipped, err := LoadMaybeGzip(&zipped)
+	if err != nil {
+		t.Fatal("could not load gzipped input →", err)
+	}
+
+	if !plain.Equal(unzipped) || len(plain.Records) != 2 {
+		t.Error("gzipped and plain input differ →", plain, unzipped)
+	}
+}
+
+// TestRecordAttributes checks if a record's head attributes are returned, even for empty records
+func TestRecordAttributes(t *testing.T) {
+	r, err := ParseRecord("host=a ip=1\n\tport=22\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	attrs := r.Attributes()
+	if len(attrs) != 2 || attrs[1].Name != "ip" {
+		t.Error("incorrect head attributes:", attrs)
+	}
+
+	empty := &Record{}
+	if attrs := empty.Attributes(); attrs != nil {
+		t.Error("expected nil attributes for an empty record, got", attrs)
+	}
+}
+
+// TestLookupInt checks if numeric keys match regardless of zero-padding
+func TestLookupInt(t *testing.T) {
+	c, err := Load(strings.NewReader("7 name=a\n007 name=b\n70 name=c\nseven name=d\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	records, ok := c.LookupInt(7)
+	if !ok || len(records) != 2 {
+		t.Fatal("expected 2 records, got", len(records))
+	}
+
+	if records[0].PrimaryKey() != "7" || records[1].PrimaryKey() != "007" {
+		t.Error("incorrect records matched →", records[0], records[1])
+	}
+
+	if _, ok := c.LookupInt(8); ok {
+		t.Error("unexpected match for a missing key")
+	}
+}
+
+// TestResolveRefs checks if references to earlier attributes in a record are resolved
+func TestResolveRefs(t *testing.T) {
+	o := DefaultOptions()
+	o.ResolveRefs = true
+
+	c, err := LoadWith(strings.NewReader("app base=/opt\n\tbase.log=${base}/log other=${elsewhere}\napp2 base.log=${base}\n"), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if v := c.Records[0].FlatMap()["base.log"]; v != "/opt/log" {
+		t.Error("incorrect resolution, got", v)
+	}
+	if v := c.Records[0].FlatMap()["other"]; v != "${elsewhere}" {
+		t.Error("unknown reference was not left as-is, got", v)
+	}
+	if v := c.Records[1].FlatMap()["base.log"]; v != "${base}" {
+		t.Error("reference resolved across records, got", v)
+	}
+
+	_, err = LoadWith(strings.NewReader("app a=${b}\n\tb=${a}\n"), o)
+	if err == nil || !strings.Contains(err.Error(), "cyclic") {
+		t.Error("expected a cyclic reference error, got", err)
+	}
+
+	_, err = LoadWith(strings.NewReader("app a=${b} b=1\n"), o)
+	if err == nil || !strings.Contains(err.Error(), "forward") {
+		t.Error("expected a forward reference error, got", err)
+	}
+}
+
+// TestEmitIndex checks if the index has a key and value line per record of the test file
+func TestEmitIndex(t *testing.T) {
+	f, err := os.Open(testFile)
+	if err != nil {
+		t.Fatal("could not open", testFile, "→", err)
+	}
+	defer f.Close()
+
+	c, err := Load(f)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	var sb strings.Builder
+	if err := c.EmitIndex(&sb); err != nil {
+		t.Fatal("could not emit →", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(sb.String(), "\n"), "\n")
+	if len(lines) != nRecords {
+		t.Fatal("expected", nRecords, "lines, got", len(lines))
+	}
+
+	ex := []string{"a\tb", "sys\tmysystem", "ipnet\thouse", "name\talice", "creds\t"}
+	for i, e := range ex {
+		if lines[i] != e {
+			t.Error("line", i+1, "wanted", e, "got", lines[i])
+		}
+	}
+}
+
+// TestMaxRecords checks if loading stops once there are too many records
+func TestMaxRecords(t *testing.T) {
+	o := DefaultOptions()
+	o.MaxRecords = 2
+
+	in := "a=1\n\tx=1\nb=2\nc=3\nd='unterminated\n"
+	c, err := LoadWith(strings.NewReader(in), o)
+	if err == nil || !strings.Contains(err.Error(), "more than 2 records") {
+		t.Fatal("expected a record limit error, got", err)
+	}
+
+	// The bad line following the limit is never reached
+	if !strings.Contains(err.Error(), "line:rune of 4:") || len(c.Records) != 2 {
+		t.Error("parsing did not stop at the limit:", err)
+	}
+
+	o.MaxRecords = 4
+	if _, err := LoadWith(strings.NewReader("a=1\nb=2\nc=3\nd=4\n"), o); err != nil {
+		t.Error("input at the limit was rejected →", err)
+	}
+}
+
+// TestNormalizeValueless checks if a mix of valueless forms is emitted uniformly
+func TestNormalizeValueless(t *testing.T) {
+	in := "k a b= c=\"\" d=''\n"
+
+	for _, omit := range []bool{false, true} {
+		c, err := Load(strings.NewReader(in))
+		if err != nil {
+			t.Fatal("could not load →", err)
+		}
+
+		OmitEmptyEquals = omit
+		c.NormalizeValueless()
+		s := c.String()
+		OmitEmptyEquals = false
+
+		ex := "k= a= b= c= d= \n"
+		if omit {
+			ex = "k a b c d \n"
+		}
+		if s != ex {
+			t.Error("with OmitEmptyEquals", omit, "wanted", ex, "got", s)
+		}
+	}
+}
+
+// TestDedent checks if common indentation is removed while child tuples stay indented
+func TestDedent(t *testing.T) {
+	in := "    sys=a\n      ip=1\n\n    sys=b\n    \tport=22\n"
+
+	c, err := Load(Dedent(strings.NewReader(in)))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if len(c.Records) != 2 || len(c.Records[0].Tuples) != 2 || len(c.Records[1].Tuples) != 2 {
+		t.Error("incorrect structure →", c)
+	}
+
+	if _, err := Load(strings.NewReader(in)); err == nil {
+		t.Error("expected the indented input to fail without Dedent")
+	}
+}
+
+// TestCollectIndexed checks if indexed names are gathered in index order
+func TestCollectIndexed(t *testing.T) {
+	r, err := ParseRecord("pool server.2=c server.0=a\n\tserver.1=b server.x=no servers.3=no\n\tserver.5=e\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	ex := []string{"a", "b", "c", "e"}
+	if got := r.CollectIndexed("server"); fmt.Sprint(got) != fmt.Sprint(ex) {
+		t.Error("wanted", ex, "got", got)
+	}
+
+	if got := r.CollectIndexed("missing"); got != nil {
+		t.Error("expected nil for a missing prefix, got", got)
+	}
+}
+
+// TestEscapeControl checks if values with control characters round-trip when escaped
+func TestEscapeControl(t *testing.T) {
+	EscapeControl = true
+	defer func() { EscapeControl = false }()
+
+	a := &Attribute{Name: "k", Value: "a\tb\nc\\x41"}
+	c := Cfg{Records: Records{{Tuples: Tuples{{Attributes: Attributes{a}}}}}}
+
+	s := c.String()
+	if s != `k=a\x09b\x0ac\x5cx41 `+"\n" {
+		t.Error("incorrect escaping:", s)
+	}
+
+	c2, err := Load(strings.NewReader(s))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if v := c2.Records[0].Tuples[0].Attributes[0].Value; v != a.Value {
+		t.Error("value did not round-trip, wanted", a.Value, "got", v)
+	}
+}
+
+// TestShadowed checks if earlier records sharing a key are reported
+func TestShadowed(t *testing.T) {
+	c, err := Load(strings.NewReader("a=1\nb=1\na=2\nc=1\na=3\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	shadowed := c.Shadowed()
+	if len(shadowed) != 2 || shadowed[0].PrimaryValue() != "1" || shadowed[1].PrimaryValue() != "2" {
+		t.Fatal("incorrect shadowed records:", shadowed)
+	}
+
+	if v := c.Map["a"]["a"]["a"]; v[0] != "3" {
+		t.Error("map does not hold the last record, got", v)
+	}
+}
+
+// Reader which blocks until its channel is closed
+type slowReader chan struct{}
+
+func (s slowReader) Read([]byte) (int, error) {
+	<-s
+	return 0, io.EOF
+}
+
+// Reader which cancels a context when read
+type cancelReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (c cancelReader) Read(p []byte) (int, error) {
+	c.cancel()
+	return c.Reader.Read(p)
+}
+
+// TestLoadTimeout checks if loading from a slow reader gives up at the deadline
+func TestLoadTimeout(t *testing.T) {
+	slow := make(slowReader)
+	defer close(slow)
+
+	_, err := LoadTimeout(slow, 10*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected the deadline to be exceeded, got", err)
+	}
+
+	c, err := LoadTimeout(strings.NewReader("a=1\n"), time.Second)
+	if err != nil || len(c.Records) != 1 {
+		t.Error("fast input failed to load:", err)
+	}
+
+	// Parsing stops between records once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	r := cancelReader{strings.NewReader("a=1\nb=1\nc=1\n"), cancel}
+	c, _, err = load(ctx, r, DefaultOptions(), false)
+	if !errors.Is(err, context.Canceled) || len(c.Records) > 1 {
+		t.Error("parsing continued after cancellation:", err, len(c.Records), "records")
+	}
+}
+
+// TestRewriteValues checks if matching values are rewritten and counted
+func TestRewriteValues(t *testing.T) {
+	c, err := Load(strings.NewReader("user=alice password=hunter2\n\tpassword=letmein\nuser=bob password=\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	n := c.RewriteValues(regexp.MustCompile(`^(hunter|letme).*`), "REDACTED")
+	if n != 2 {
+		t.Error("expected 2 changes, got", n)
+	}
+
+	ex := "user=alice password=REDACTED \n\tpassword=REDACTED \nuser=bob password= \n"
+	if s := c.String(); s != ex {
+		t.Error("incorrect rewrite, wanted", ex, "got", s)
+	}
+
+	if v := c.Maps()["user"]["user"]["password"]; len(v) != 0 {
+		t.Error("map not refreshed:", c.Maps()["user"])
+	}
+	if v := c.Records[0].Tuples[1].Map["password"]; v[0] != "REDACTED" {
+		t.Error("tuple map not refreshed:", v)
+	}
+}
+
+// TestAppendRecordWithTimestamp checks if an appended record's timestamp reads back
+func TestAppendRecordWithTimestamp(t *testing.T) {
+	c, err := Load(strings.NewReader("event=boot\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	r, err := ParseRecord("event=login user=alice\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	ts := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+	c.AppendRecordWithTimestamp(r, ts)
+
+	if s := c.Records[1].String(); s != "event=login ts=2021-06-01T12:30:00Z user=alice \n" {
+		t.Error("incorrect record:", s)
+	}
+
+	got, ok := c.Records[1].Timestamp()
+	if !ok || !got.Equal(ts) {
+		t.Error("incorrect timestamp, wanted", ts, "got", got)
+	}
+
+	if _, ok := c.Records[0].Timestamp(); ok {
+		t.Error("unexpected timestamp on a record without one")
+	}
+
+	// An empty head is keyed by the timestamp
+	c.AppendRecordWithTimestamp(&Record{Tuples: Tuples{{}}}, ts)
+	if s := c.Records[2].String(); s != "ts=2021-06-01T12:30:00Z \n" {
+		t.Error("incorrect record with an empty head:", s)
+	}
+}
+
+// TestStableString checks if repeated loads of the same input emit identically
+func TestStableString(t *testing.T) {
+	in, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatal("could not read", testFile, "→", err)
+	}
+
+	var first string
+	for i := 0; i < 100; i++ {
+		c, err := Load(strings.NewReader(string(in)))
+		if err != nil {
+			t.Fatal("could not load →", err)
+		}
+
+		s := c.StableString()
+		if i == 0 {
+			first = s
+			continue
+		}
+
+		if s != first {
+			t.Fatal("emission", i, "differs →", first, s)
+		}
+	}
+}
+
+// TestQuery checks if paths into the test file resolve to their values
+func TestQuery(t *testing.T) {
+	f, err := os.Open(testFile)
+	if err != nil {
+		t.Fatal("could not open", testFile, "→", err)
+	}
+	defer f.Close()
+
+	c, err := Load(f)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	tests := []struct {
+		path string
+		ex   []string
+		ok   bool
+	}{
+		{"ipnet/auth/authdom", []string{"HOME"}, true},
+		{"ipnet/auth", []string{"1.2.3.4"}, true},
+		{"ipnet/ipgw/ipgw", []string{"1.2.3.1"}, true},
+		{"creds/trust/known", []string{}, true},
+		{"ipnet/auth/missing", nil, false},
+		{"missing/auth", nil, false},
+		{"ipnet", nil, false},
+	}
+
+	for _, test := range tests {
+		vals, ok := c.Query(test.path)
+		if ok != test.ok || fmt.Sprint(vals) != fmt.Sprint(test.ex) {
+			t.Error(test.path, "wanted", test.ex, test.ok, "got", vals, ok)
+		}
+	}
+}
+
+// TestPruneEmpty checks if only records without attributes beyond a valueless key are removed
+func TestPruneEmpty(t *testing.T) {
+	c, err := Load(strings.NewReader("blank\nkeep=1\nflag\n\tother\nquoted=\"\"\nempty\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	// A record whose indented tuples were emptied by editing
+	c.Records[len(c.Records)-1].Tuples = append(c.Records[len(c.Records)-1].Tuples, &Tuple{})
+	c.Records = append(c.Records, &Record{})
+
+	if n := c.PruneEmpty(); n != 3 {
+		t.Error("expected 3 records pruned, got", n)
+	}
+
+	ex := []string{"keep", "flag", "quoted"}
+	if keys := c.Keys(); fmt.Sprint(keys) != fmt.Sprint(ex) {
+		t.Error("incorrect records kept, wanted", ex, "got", keys)
+	}
+
+	if _, ok := c.Maps()["blank"]; ok {
+		t.Error("map was not rebuilt")
+	}
+}
+
+// TestTemplate checks if a template keeps the structure of a cfg with blank values
+func TestTemplate(t *testing.T) {
+	c, err := Load(strings.NewReader("host=a ip=1.2.3.4\n\tport=22 proto=tcp\nhost=b ip=1.2.3.5\nuser=alice key=\"\"\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	tmpl := c.Template()
+
+	ex := "host= ip= \n\tport= proto= \nuser= key= \n"
+	if s := tmpl.String(); s != ex {
+		t.Error("incorrect template, wanted", ex, "got", s)
+	}
+
+	if v := c.Records[0].PrimaryValue(); v != "a" {
+		t.Error("original cfg was modified")
+	}
+
+	if vals, ok := tmpl.Map["host"]["port"]["proto"]; !ok || len(vals) != 0 {
+		t.Error("incorrect template map:", tmpl.Map["host"])
+	}
+}
+
+// TestMissingValues checks if only empty-valued required names are reported
+func TestMissingValues(t *testing.T) {
+	in := "host=a ip= port=22 debug\n\tuser=\"\" pass=\nhost=b ip=1.2.3.5 port=\n"
+	c, err := Load(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	matches := c.MissingValues("ip", "port", "user", "debug")
+
+	var got []string
+	for _, m := range matches {
+		got = append(got, m.Record.PrimaryValue()+"/"+m.Tuple.PrimaryKey()+"/"+m.Attribute.Name)
+	}
+
+	ex := []string{"a/host/ip", "a/user/user", "b/host/port"}
+	if fmt.Sprint(got) != fmt.Sprint(ex) {
+		t.Error("wanted", ex, "got", got)
+	}
+}
+
+// TestLookupIndex checks if indexed lookups match a linear scan, including after edits
+func TestLookupIndex(t *testing.T) {
+	c, err := Load(strings.NewReader("a=1\nb=1\na=2\nc=1\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	check := func(when string) {
+		for _, k := range []string{"a", "b", "c", "d", "e", "f", "1", "missing"} {
+			got, ok := c.Lookup(k)
+			ex := c.lookup(k)
+			if ok != (len(ex) > 0) || fmt.Sprint(got) != fmt.Sprint(ex) {
+				t.Error(when, "lookup of", k, "differs, wanted", ex, "got", got)
+			}
+		}
+	}
+
+	check("loaded")
+
+	// Appending to a result doesn't change the index
+	got, _ := c.Lookup("a")
+	_ = append(got, c.Records[1])
+	check("appended to result")
+
+	r, _ := ParseRecord("d=1\n")
+	c.Records = append(c.Records, r)
+	check("added record")
+
+	c.Records[1].Tuples[0].Attributes[0].Name = "a"
+	c.Invalidate()
+	check("renamed record")
+
+	r, _ = ParseRecord("e=1\n")
+	c.Records[0] = r
+	c.Invalidate()
+	check("replaced record")
+
+	// The index is rebuilt once after invalidation, not on every lookup
+	c.Invalidate()
+	c.Lookup("a")
+	index := c.index
+	c.Lookup("b")
+	if fmt.Sprintf("%p", index) != fmt.Sprintf("%p", c.index) {
+		t.Error("index was rebuilt by a lookup of a clean index")
+	}
+
+	KeyByPrimaryValue = true
+	check("keyed by value")
+	KeyByPrimaryValue = false
+
+	PrimaryKeyIndex = 1
+	c.Records[0].Tuples[0].Attributes = append(c.Records[0].Tuples[0].Attributes, &Attribute{Name: "f"})
+	c.Invalidate()
+	check("keyed by index")
+	PrimaryKeyIndex = 0
+}
+
+// TestKeepRaw checks if unedited attributes are emitted exactly as loaded
+func TestKeepRaw(t *testing.T) {
+	in := "\"host\"=web01 motd='hello   world' quote=\"say \"\"hi\"\"\" empty='' flag= # note\n\t'port'=22\n"
+
+	o := DefaultOptions()
+	o.KeepRaw = true
+	c, err := LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if s := c.String(); s != in {
+		t.Error("source text not kept, wanted", in, "got", s)
+	}
+
+	// Edited attributes are emitted from their fields
+	c.Records[0].Tuples[0].Attributes[1].Value = "bye"
+	c.Records[0].Tuples[1].Attributes[0].Name = "ssh"
+
+	ex := "\"host\"=web01 motd=bye quote=\"say \"\"hi\"\"\" empty='' flag= # note\n\tssh=22 \n"
+	if s := c.String(); s != ex {
+		t.Error("edited attributes not recomputed, wanted", ex, "got", s)
+	}
+
+	// Without KeepRaw nothing is recorded
+	c, err = Load(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+	if raw := c.Records[0].Tuples[0].Attributes[0].Raw; raw != "" {
+		t.Error("unexpected raw text", raw)
+	}
+
+	// Spacing between attributes and indentation are kept
+	in = "a=1    b=2\t c=3\n    d=4  e=5\n  \tf=6   # note\n"
+	c, err = LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+	if s := c.String(); s != in {
+		t.Error("spacing not kept, wanted", in, "got", s)
+	}
+
+	c.Records[0].Tuples[0].Attributes[1].Value = "3"
+	ex = "a=1    b=3 c=3\n    d=4  e=5\n  \tf=6   # note\n"
+	if s := c.String(); s != ex {
+		t.Error("spacing around an edit incorrect, wanted", ex, "got", s)
+	}
+
+	// Source text follows the scanner rather than whitespace, so adjacent and discarded tokens can't shift it
+	c, err = LoadWith(strings.NewReader("rec a\"b\" ''\n"), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	attrs := c.Records[0].Tuples[0].Attributes
+	if len(attrs) != 3 || attrs[1].Raw != "a" || attrs[2].Raw != `"b"` {
+		t.Fatal("incorrect source text, got:", attrs)
+	}
+
+	attrs[1].Value = "1"
+	after, err := Load(strings.NewReader(c.String()))
+	if err != nil {
+		t.Fatal("could not load emission →", err)
+	}
+	if names := fmt.Sprint(after.Keys(), len(after.Records[0].Tuples[0].Attributes)); names != "[rec] 3" {
+		t.Error("attribute lost after an edit, got:", c.String())
+	}
+}
+
+// TestMergeDuplicates checks if records sharing a key are combined in order
+func TestMergeDuplicates(t *testing.T) {
+	c, err := Load(strings.NewReader("sys=a\n\tip=1\nother=x\nsys=b\n\tport=22\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	c.MergeDuplicates()
+
+	if len(c.Records) != len(c.Maps()) || len(c.Records) != 2 {
+		t.Fatal("record and map counts disagree:", len(c.Records), "and", len(c.Maps()))
+	}
+
+	ex := "sys=a \n\tip=1 \n\tsys=b \n\tport=22 \nother=x \n"
+	if s := c.String(); s != ex {
+		t.Error("incorrect merge, wanted", ex, "got", s)
+	}
+
+	if _, ok := c.Maps()["sys"]["port"]; !ok {
+		t.Error("map not rebuilt:", c.Maps()["sys"])
+	}
+}
+
+// TestQuoteWhitespace checks if values with any whitespace, but no spaces between words, round-trip
+func TestQuoteWhitespace(t *testing.T) {
+	for _, v := range []string{"\t", "a\tb", " lead", "trail ", "\u00a0"} {
+		a := &Attribute{Name: "k", Value: v}
+		s := a.String()
+		if s == "k="+v {
+			t.Error(v, "was not quoted")
+		}
+
+		c, err := Load(strings.NewReader(s + "\n"))
+		if err != nil {
+			t.Fatal("could not load", s, "→", err)
+		}
+
+		if got := c.Records[0].PrimaryValue(); got != v {
+			t.Error(v, "did not round-trip, got", got)
+		}
+	}
+}
+
+// TestDoubleEqualsEscape checks if a doubled equals is a literal equals under the option
+func TestDoubleEqualsEscape(t *testing.T) {
+	in := "k=a==b x==y=1 z==\n"
+
+	o := DefaultOptions()
+	o.DoubleEqualsEscape = true
+	c, err := LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	attrs := c.Records[0].Tuples[0].Attributes
+	ex := []string{"k", "a=b", "x=y", "1", "z=", ""}
+	if len(attrs) != 3 {
+		t.Fatal("expected 3 attributes, got", c)
+	}
+	for i, a := range attrs {
+		if a.Name != ex[2*i] || a.Value != ex[2*i+1] {
+			t.Error("attribute", i, "wanted", ex[2*i]+"="+ex[2*i+1], "got", a.Name+"="+a.Value)
+		}
+	}
+
+	c, err = Load(strings.NewReader("k=a==b\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+	if v := c.Records[0].PrimaryValue(); v == "a=b" {
+		t.Error("doubled equals escaped without the option")
+	}
+}
+
+// TestMissingAttribute checks if records without a name in any tuple are found in the test file
+func TestMissingAttribute(t *testing.T) {
+	f, err := os.Open(testFile)
+	if err != nil {
+		t.Fatal("could not open", testFile, "→", err)
+	}
+	defer f.Close()
+
+	c, err := Load(f)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	missing := c.MissingAttribute("authdom")
+	if len(missing) != nRecords-2 {
+		t.Error("expected", nRecords-2, "records, got", len(missing))
+	}
+
+	for _, r := range missing {
+		if k := r.PrimaryKey(); k == "sys" || k == "ipnet" {
+			t.Error("record", k, "has authdom but was reported")
+		}
+	}
+
+	if missing := c.MissingAttribute("a"); len(missing) != nRecords-1 {
+		t.Error("expected every record but one, got", len(missing))
+	}
+}
+
+// TestInline checks the single line form of a multi-tuple record
+func TestInline(t *testing.T) {
+	r, err := ParseRecord("key a=1 b=2 # comment\n\tsub c=3\n\tlone\n\thost=x 'd e'=\"f g\"\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	ex := `key: a=1 b=2 | sub: c=3 | lone | host=x: "d e"="f g"`
+	if s := r.Inline(); s != ex {
+		t.Error("wanted", ex, "got", s)
+	}
+}
+
+// TestGreedyQuotes contrasts default and greedy quote closing
+func TestGreedyQuotes(t *testing.T) {
+	in := "k=\"a\"b\"c\" s='x'y' d=\"it''s\"\"q\"\"\" n=\"a \"b\"\n"
+
+	c, err := Load(strings.NewReader("k=\"a\"b\"c\"\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+	if v := c.Records[0].PrimaryValue(); v != "a" {
+		t.Error("default: the first quote should close, got", v)
+	}
+
+	o := DefaultOptions()
+	o.GreedyQuotes = true
+	c, err = LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	ex := map[string]string{"k": `a"b"c`, "s": "x'y", "d": `it''s"q"`, "n": `a "b`}
+	if m := c.Records[0].FlatMap(); fmt.Sprint(m) != fmt.Sprint(ex) {
+		t.Error("greedy: wanted", ex, "got", m)
+	}
+}
+
+// TestRecordSplit checks if a multi-tuple record splits into keyed single-tuple records
+func TestRecordSplit(t *testing.T) {
+	r, err := ParseRecord("ipnet=house ip=1.2.3.0\n\tipgw=1.2.3.1\n\tdns=5.6.7.8 dns=5.6.7.9\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	split := r.Split()
+	if len(split) != 3 {
+		t.Fatal("expected 3 records, got", len(split))
+	}
+
+	ex := []string{
+		"ipnet=house ip=1.2.3.0 \n",
+		"ipnet=house ipgw=1.2.3.1 \n",
+		"ipnet=house dns=5.6.7.8 dns=5.6.7.9 \n",
+	}
+	for i, s := range split {
+		if s.PrimaryKey() != "ipnet" || s.String() != ex[i] {
+			t.Error("record", i, "wanted", ex[i], "got", s.String())
+		}
+	}
+
+	if len(r.Tuples[1].Attributes) != 1 {
+		t.Error("the original record was modified")
+	}
+
+	// The primary attribute keys each split record at PrimaryKeyIndex
+	PrimaryKeyIndex = 1
+	defer func() { PrimaryKeyIndex = 0 }()
+
+	ex = []string{
+		"ipnet=house ip=1.2.3.0 \n",
+		"ipgw=1.2.3.1 ip=1.2.3.0 \n",
+		"dns=5.6.7.8 ip=1.2.3.0 dns=5.6.7.9 \n",
+	}
+	for i, s := range r.Split() {
+		if s.PrimaryKey() != "ip" || s.String() != ex[i] {
+			t.Error("record", i, "keyed by index: wanted", ex[i], "got", s.String())
+		}
+	}
+}
+
+// TestLoadNoFinalNewline checks if the last line is kept when input doesn't end in a newline
+func TestLoadNoFinalNewline(t *testing.T) {
+	c, err := Load(strings.NewReader("a=b\nc=d\n\tx=1\nforce="))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	ex := []string{"a", "c", "force"}
+	if keys := c.Keys(); fmt.Sprint(keys) != fmt.Sprint(ex) {
+		t.Error("wanted keys", ex, "got", keys)
+	}
+
+	// A final indented tuple is kept as well
+	c, err = Load(strings.NewReader("a=b\n\tx=1 y=2"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+	if n := len(c.Records[0].Tuples); n != 2 {
+		t.Error("expected 2 tuples, got", n)
+	}
+}
+
+// TestIsRecordStart checks if a predicate can mark record boundaries in place of indentation
+func TestIsRecordStart(t *testing.T) {
+	o := DefaultOptions()
+	o.IsRecordStart = func(line string) bool {
+		return strings.HasPrefix(line, "[")
+	}
+
+	in := "[web] host=a\nip=1.2.3.4\n  port=80 # indented or not\n\n[db] host=b\nport=5432\n"
+	c, err := LoadWith(strings.NewReader(in), o)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if keys := c.Keys(); fmt.Sprint(keys) != "[[web] [db]]" {
+		t.Fatal("incorrect records:", keys)
+	}
+
+	if n := len(c.Records[0].Tuples); n != 3 {
+		t.Error("expected 3 tuples in the first record, got", n)
+	}
+
+	if v := c.Map["[db]"]["port"]["port"]; len(v) != 1 || v[0] != "5432" {
+		t.Error("incorrect second record:", c.Map["[db]"])
+	}
+
+	// Lines before the first record start have no parent
+	if _, err := LoadWith(strings.NewReader("orphan=1\n[web]\n"), o); err == nil {
+		t.Error("expected an error for a line before the first record")
+	}
+}
+
+// TestBlame checks attribute positions against the test file
+func TestBlame(t *testing.T) {
+	f, err := os.Open(testFile)
+	if err != nil {
+		t.Fatal("could not open", testFile, "→", err)
+	}
+	defer f.Close()
+
+	c, err := Load(f)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	blame := c.Blame()
+	find := func(record, name string) (uint64, uint64) {
+		for _, b := range blame {
+			if b.Record == record && b.Name == name {
+				return b.Line, b.Col
+			}
+		}
+		t.Fatal(record+"/"+name, "not found")
+		return 0, 0
+	}
+
+	tests := []struct {
+		record, name string
+		line, col    uint64
+	}{
+		{"a", "a", 2, 1},
+		{"sys", "dom", 6, 14},
+		{"ipnet", "ipgw", 8, 2},
+		{"ipnet", "authdom", 9, 15},
+		{"blank", "second", 33, 10},
+	}
+
+	for _, test := range tests {
+		if line, col := find(test.record, test.name); line != test.line || col != test.col {
+			t.Error(test.record+"/"+test.name, "wanted line", test.line, "rune", test.col, "got", line, col)
+		}
+	}
+
+	// Adjacent and discarded tokens don't shift columns
+	c, err = Load(strings.NewReader("rec a\"b\" ''\n"))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	blame = c.Blame()
+	if len(blame) != 3 || blame[2].Name != "b" || blame[2].Col != 6 {
+		t.Error("incorrect position for b, got:", blame)
+	}
+}
+
+// TestBase64Names checks if listed values round-trip base64-encoded
+func TestBase64Names(t *testing.T) {
+	Base64Names = []string{"blob"}
+	defer func() { Base64Names = nil }()
+
+	blob := "line one\nsaid \"hi\" 'there' # not a comment\x00\xff"
+	c := Cfg{Records: Records{{Tuples: Tuples{{Attributes: Attributes{
+		{Name: "key", Value: "a"},
+		{Name: "blob", Value: blob},
+	}}}}}}
+
+	s := c.String()
+	if ex := "key=a blob=" + base64.RawStdEncoding.EncodeToString([]byte(blob)) + " \n"; s != ex {
+		t.Error("value not encoded, wanted", ex, "got", s)
+	}
+
+	// Load decodes the names listed in the global
+	loaded, err := Load(strings.NewReader(s))
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	if v := loaded.Records[0].FlatMap()["blob"]; v != blob {
+		t.Error("value did not round-trip, wanted", blob, "got", v)
+	}
+
+	o := DefaultOptions()
+	Base64Names = nil
+	if len(o.Base64Names) != 1 {
+		t.Error("options not seeded from the global, got:", o.Base64Names)
+	}
+
+	// Padded values load if quoted
+	loaded, err = LoadWith(strings.NewReader("key=a blob=\"YQ==\"\n"), o)
+	if err != nil || loaded.Records[0].FlatMap()["blob"] != "a" {
+		t.Error("padded value did not load:", err)
+	}
+
+	if _, err := LoadWith(strings.NewReader("key=a blob=!!\n"), o); err == nil {
+		t.Error("expected an error for invalid base64")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+// Package cfgtest provides helpers for testing code which produces cfgs.
+package cfgtest
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/seh-msft/cfg"
+)
+
+// AssertEqualFile fails the test if 'c' is not Equal to the cfg loaded from the golden file at 'goldenPath'.
+// On failure the emitted forms are diffed line by line, - lines being only in the golden file and + lines only in 'c'.
+func AssertEqualFile(t testing.TB, c cfg.Cfg, goldenPath string) {
+	t.Helper()
+
+	f, err := os.Open(goldenPath)
+	if err != nil {
+		t.Fatalf("could not open golden file %s → %v", goldenPath, err)
+		return
+	}
+	defer f.Close()
+
+	golden, err := cfg.Load(f)
+	if err != nil {
+		t.Fatalf("could not load golden file %s → %v", goldenPath, err)
+		return
+	}
+
+	if c.Equal(golden) {
+		return
+	}
+
+	t.Errorf("cfg differs from golden file %s:\n%s", goldenPath, diff(golden.String(), c.String()))
+}
+
+// Line diff of 'a' to 'b' from their longest common subsequence of lines
+func diff(a, b string) string {
+	al := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bl := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// lcs[i][j] is the length of the common subsequence of al[i:] and bl[j:]
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			switch {
+			case al[i] == bl[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			out.WriteString("  " + al[i] + "\n")
+			i++
+			j++
+		case j >= len(bl) || (i < len(al) && lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("- " + al[i] + "\n")
+			i++
+		default:
+			out.WriteString("+ " + bl[j] + "\n")
+			j++
+		}
+	}
+
+	return out.String()
+}
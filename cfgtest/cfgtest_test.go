@@ -0,0 +1,58 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfgtest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/seh-msft/cfg"
+)
+
+const golden = "../test.cfg"
+
+// Records failures rather than failing the test
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+}
+
+// TestAssertEqualFile checks the test file against itself, and a changed copy against it
+func TestAssertEqualFile(t *testing.T) {
+	f, err := os.Open(golden)
+	if err != nil {
+		t.Fatal("could not open", golden, "→", err)
+	}
+	defer f.Close()
+
+	c, err := cfg.Load(f)
+	if err != nil {
+		t.Fatal("could not load →", err)
+	}
+
+	AssertEqualFile(t, c, golden)
+
+	c.Records[0].Tuples[0].Attributes[0].Value = "changed"
+	rec := &recorder{TB: t}
+	AssertEqualFile(rec, c, golden)
+
+	if len(rec.failures) != 1 {
+		t.Fatal("expected one failure, got", rec.failures)
+	}
+	if msg := rec.failures[0]; !strings.Contains(msg, "- a=b \n+ a=changed \n") {
+		t.Error("failure does not show the change:", msg)
+	}
+}
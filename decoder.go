@@ -0,0 +1,156 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Decoder reads records from a cfg file one at a time, Load reads every record with one.
+type Decoder struct {
+	Options Options // Parsing options, may be changed before the first call to Next
+
+	br      *bufio.Reader
+	ln      uint64       // Line number
+	word    bytes.Buffer // Scratch space for the scanner
+	rec     *Record      // Record whose tuples are still being read
+	records int          // Number of records started
+
+	skip     bool          // Skip orphaned tuples as warnings rather than failing, for LoadVerbose
+	warnings []*ParseError // Skipped orphaned tuples
+}
+
+// NewDecoder returns a Decoder reading from 'r' with DefaultOptions.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		Options: DefaultOptions(),
+		br:      bufio.NewReader(r),
+	}
+}
+
+// Next returns the next record, or io.EOF once every record has been read.
+// A record is only complete once the following unindented line, or the end of input, is read.
+func (d *Decoder) Next() (*Record, error) {
+	for {
+		line, err := d.br.ReadString('\n')
+		switch {
+		case err == io.EOF && line == "":
+			if d.rec == nil {
+				return nil, io.EOF
+			}
+
+			r := d.rec
+			d.rec = nil
+			return d.finish(r)
+
+		case err == io.EOF:
+			// The final line has no newline, which the scanner needs to finish the last attribute
+			line += "\n"
+
+		case err != nil:
+			return nil, err
+		}
+		d.ln++
+
+		tuple, in, col, err := parseLine(line, d.ln, &d.word, d.Options)
+		if err != nil {
+			return nil, err
+		}
+		if tuple == nil {
+			continue
+		}
+		tuples := splitNames(tuple, d.Options.SplitNames)
+
+		if in {
+			// Append Tuple to the record in progress
+			if d.rec == nil {
+				orphan := &ParseError{Line: d.ln, Col: col, Msg: errNoParent}
+				if d.skip {
+					d.warnings = append(d.warnings, orphan)
+					continue
+				}
+				return nil, orphan
+			}
+
+			d.rec.Tuples = append(d.rec.Tuples, tuples...)
+			continue
+		}
+
+		if limit := d.Options.MaxRecords; limit > 0 && d.records >= limit {
+			return nil, &ParseError{Line: d.ln, Col: col, Msg: fmt.Sprintf("more than %d records", limit)}
+		}
+		d.records++
+
+		// New Record with just this tuple, the previous record is done
+		r := d.rec
+		d.rec = &Record{
+			Tuples: tuples,
+		}
+
+		if r != nil {
+			return d.finish(r)
+		}
+	}
+}
+
+// Apply options which need a complete record
+func (d *Decoder) finish(r *Record) (*Record, error) {
+	if d.Options.ResolveRefs {
+		if err := resolveRefs(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// LookupInReader returns the first record read from 'r' whose primary key matches 'key'.
+// Reading stops once the record is complete, no other records are kept.
+func LookupInReader(r io.Reader, key string) (*Record, bool, error) {
+	d := NewDecoder(r)
+
+	for {
+		rec, err := d.Next()
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		if rec.PrimaryKey() == key {
+			return rec, true, nil
+		}
+	}
+}
+
+// FilterStream copies the records from 'r' for which 'keep' returns true to 'w'.
+// Only one record is held in memory at a time.
+func FilterStream(r io.Reader, w io.Writer, keep func(primaryKey string) bool) error {
+	d := NewDecoder(r)
+	bw := bufio.NewWriter(w)
+
+	for {
+		rec, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if !keep(rec.PrimaryKey()) {
+			continue
+		}
+
+		if _, err := bw.WriteString(rec.String()); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestFilterStream checks if records are filtered from a reader to a writer
+func TestFilterStream(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	drop := map[string]bool{"ipnet": true, "creds": true, "blank": true}
+	var sb strings.Builder
+	err = FilterStream(f, &sb, func(key string) bool {
+		return !drop[key]
+	})
+	if err != nil {
+		t.Fatal("could not filter →", err)
+	}
+
+	c, err := Load(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal("could not load filtered output →", err)
+	}
+
+	exKeys := []string{`a`, `sys`, `name`, `force`, `c`, `sentence`, `sing`, `quoted`, `test id`, `use bob's code`, `foo`, `bar`}
+	keys := c.Keys()
+	if len(keys) != len(exKeys) {
+		t.Fatal("incorrect keys, got:", keys)
+	}
+
+	for i := range keys {
+		if keys[i] != exKeys[i] {
+			t.Error("mismatched primary keys, wanted", exKeys[i], "got", keys[i])
+		}
+	}
+
+	// Kept records are intact
+	sys, ok := c.Lookup("sys")
+	if !ok || len(sys[0].Tuples[0].Attributes) != 5 {
+		t.Error("sys record was altered")
+	}
+}
+
+// Reader which counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// TestLookupInReader checks if a mid-file record is found without reading the rest of the input
+func TestLookupInReader(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&sb, "host=web%d ip=1.2.3.4\n\tport=%d\n", i, i)
+	}
+	in := sb.String()
+
+	cr := &countingReader{r: strings.NewReader(in)}
+	KeyByPrimaryValue = true
+	defer func() { KeyByPrimaryValue = false }()
+
+	r, ok, err := LookupInReader(cr, "web500")
+	if err != nil || !ok {
+		t.Fatal("record not found:", err)
+	}
+
+	if v, _ := r.GetLast("port"); v != "500" {
+		t.Error("incorrect record returned →", r)
+	}
+
+	if cr.n >= len(in) {
+		t.Error("the whole input was read,", cr.n, "of", len(in), "bytes")
+	}
+
+	if _, ok, err := LookupInReader(strings.NewReader(in), "missing"); ok || err != nil {
+		t.Error("unexpected result for a missing key:", ok, err)
+	}
+}
+
+// TestDecoderNoFinalNewline checks if the decoder keeps the last line when input doesn't end in a newline
+func TestDecoderNoFinalNewline(t *testing.T) {
+	d := NewDecoder(strings.NewReader("a=b\nc=d\n\tx=1"))
+
+	var keys []string
+	var last *Record
+	for {
+		r, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("could not decode →", err)
+		}
+		keys = append(keys, r.PrimaryKey())
+		last = r
+	}
+
+	if fmt.Sprint(keys) != "[a c]" || len(last.Tuples) != 2 {
+		t.Error("final line dropped:", keys, "→", last)
+	}
+}
+
+// TestDecoderErrors checks if the decoder and Load report errors identically, at accurate positions
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		pos string
+	}{
+		{"a=1\n\tb=2\nc=3\n\n\td='bad\n", "line:rune of 5:"},
+		{"\torphan=1\na=1\n", "line:rune of 1:"},
+		{"a=1\nb=2\nc=3\nd=\"bad\n", "line:rune of 4:"},
+	}
+
+	for _, test := range tests {
+		d := NewDecoder(strings.NewReader(test.in))
+		var derr error
+		for derr == nil {
+			_, derr = d.Next()
+		}
+
+		_, lerr := Load(strings.NewReader(test.in))
+
+		if derr == io.EOF || lerr == nil {
+			t.Fatal(test.in, "expected errors, got", derr, "and", lerr)
+		}
+
+		if derr.Error() != lerr.Error() {
+			t.Error(test.in, "decoder and Load errors differ:", derr, lerr)
+		}
+
+		if !strings.Contains(derr.Error(), test.pos) {
+			t.Error(test.in, "expected position", test.pos, "got", derr)
+		}
+	}
+
+	_, err := Load(strings.NewReader("\torphan=1\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), errNoParent) {
+		t.Error("incorrect orphan error:", err)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Diagnostic is a problem found while loading a cfg file, positioned for an editor.
+type Diagnostic struct {
+	Line     uint64 `json:"line"`     // Line number starting at 1, 0 if unknown
+	Col      uint64 `json:"col"`      // Rune within the line starting at 1, 0 if unknown
+	Severity string `json:"severity"` // "error" if loading failed, otherwise "warning"
+	Message  string `json:"message"`
+}
+
+// Diagnostics loads the cfg file from 'r' as LoadVerbose does and returns its problems as a JSON array of Diagnostic.
+// Skipped orphaned tuples are warnings and an error which stops loading is the final entry.
+// The returned error is only for failures to encode the diagnostics.
+func Diagnostics(r io.Reader) ([]byte, error) {
+	out := []Diagnostic{}
+
+	_, warnings, err := load(context.Background(), r, DefaultOptions(), true)
+	for _, w := range warnings {
+		out = append(out, diagnose(w, "warning"))
+	}
+	if err != nil {
+		out = append(out, diagnose(err, "error"))
+	}
+
+	return json.Marshal(out)
+}
+
+// Position an error if it is a ParseError
+func diagnose(err error, severity string) Diagnostic {
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		return Diagnostic{Severity: severity, Message: err.Error()}
+	}
+
+	return Diagnostic{Line: pe.Line, Col: pe.Col, Severity: severity, Message: pe.Msg}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestDiagnostics checks if warnings and errors are reported with their positions
+func TestDiagnostics(t *testing.T) {
+	in := "\torphan=1\nsys=a\n\tip=1\nsys=b auth='unterminated\n"
+
+	out, err := Diagnostics(strings.NewReader(in))
+	if err != nil {
+		t.Fatal("could not produce diagnostics →", err)
+	}
+
+	var got []Diagnostic
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal("invalid JSON", out, "→", err)
+	}
+
+	if len(got) != 2 {
+		t.Fatal("expected 2 diagnostics, got", out)
+	}
+
+	if d := got[0]; d.Line != 1 || d.Col != 2 || d.Severity != "warning" || !strings.HasPrefix(d.Message, "no parent record") {
+		t.Error("incorrect warning:", d)
+	}
+
+	// The column is that of the opening quote
+	if d := got[1]; d.Line != 4 || d.Col != 12 || d.Severity != "error" || d.Message != "unterminated single quote (')" {
+		t.Error("incorrect error:", d)
+	}
+
+	if !strings.Contains(string(out), `"severity":"warning"`) {
+		t.Error("unexpected JSON field names:", out)
+	}
+
+	_, err = Load(strings.NewReader("sys=a\n\tk=\"open\n"))
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Line != 2 || pe.Col != 4 || pe.Msg != `unterminated double quote (")` {
+		t.Error("incorrect parse error:", err)
+	}
+
+	out, err = Diagnostics(strings.NewReader("sys=a\n"))
+	if err != nil || string(out) != "[]" {
+		t.Error("expected an empty array for a clean file, got", out, err)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GoSource returns Go source declaring 'varName' as a map literal equal to the cfg's BuildMap output.
+// Keys are sorted so the output is deterministic.
+func (c Cfg) GoSource(varName string) string {
+	var sb strings.Builder
+
+	sb.WriteString("var " + varName + " = map[string]map[string]map[string][]string{\n")
+	for _, rk := range sortedKeys(c.BuildMap()) {
+		tuples := c.Map[rk]
+		sb.WriteString("\t" + strconv.Quote(rk) + ": {\n")
+
+		for _, tk := range sortedKeys(tuples) {
+			attrs := tuples[tk]
+			sb.WriteString("\t\t" + strconv.Quote(tk) + ": {\n")
+
+			for _, n := range sortedKeys(attrs) {
+				var values []string
+				for _, v := range attrs[n] {
+					values = append(values, strconv.Quote(v))
+				}
+
+				sb.WriteString("\t\t\t" + strconv.Quote(n) + ": {" + strings.Join(values, ", ") + "},\n")
+			}
+			sb.WriteString("\t\t},\n")
+		}
+		sb.WriteString("\t},\n")
+	}
+	sb.WriteString("}\n")
+
+	return sb.String()
+}
+
+// Sorted keys of a map keyed by strings
+func sortedKeys[V any](m map[string]V) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// TestGoSource checks if generated source reconstructs the cfg's map
+func TestGoSource(t *testing.T) {
+	path := testFile
+	f, err := os.Open(path)
+	if err != nil {
+		t.Error("could not open", path, "→", err)
+	}
+
+	c, err := Load(f)
+	if err != nil {
+		t.Error("could not load →", err)
+	}
+
+	src := "package gen\n\n" + c.GoSource("config")
+	file, err := parser.ParseFile(token.NewFileSet(), "gen.go", src, 0)
+	if err != nil {
+		t.Fatal("could not parse generated source →", err, "\n", src)
+	}
+
+	spec := file.Decls[0].(*ast.GenDecl).Specs[0].(*ast.ValueSpec)
+	if spec.Names[0].Name != "config" {
+		t.Error("incorrect variable name:", spec.Names[0].Name)
+	}
+
+	// Rebuild the map from the literal
+	m := make(map[string]map[string]map[string][]string)
+	for _, re := range astElts(t, spec.Values[0]) {
+		rkv := re.(*ast.KeyValueExpr)
+		rk := astString(t, rkv.Key)
+		m[rk] = make(map[string]map[string][]string)
+
+		for _, te := range astElts(t, rkv.Value) {
+			tkv := te.(*ast.KeyValueExpr)
+			tk := astString(t, tkv.Key)
+			m[rk][tk] = make(map[string][]string)
+
+			for _, ae := range astElts(t, tkv.Value) {
+				akv := ae.(*ast.KeyValueExpr)
+				values := []string{}
+				for _, v := range astElts(t, akv.Value) {
+					values = append(values, astString(t, v))
+				}
+				m[rk][tk][astString(t, akv.Key)] = values
+			}
+		}
+	}
+
+	if len(m) != len(c.Map) {
+		t.Error("mismatched record counts")
+	}
+
+	for rk, tuples := range c.Map {
+		for tk, attrs := range tuples {
+			for n, values := range attrs {
+				got, ok := m[rk][tk][n]
+				if !ok || len(got) != len(values) {
+					t.Error("mismatched values for", rk, tk, n)
+					continue
+				}
+
+				for i := range values {
+					if got[i] != values[i] {
+						t.Error("mismatched value for", rk, tk, n, "wanted", values[i], "got", got[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+// Elements of a composite literal
+func astElts(t *testing.T, e ast.Expr) []ast.Expr {
+	cl, ok := e.(*ast.CompositeLit)
+	if !ok {
+		t.Fatal("expected a composite literal, got", e)
+	}
+
+	return cl.Elts
+}
+
+// Value of a string literal
+func astString(t *testing.T, e ast.Expr) string {
+	s, err := strconv.Unquote(e.(*ast.BasicLit).Value)
+	if err != nil {
+		t.Fatal("could not unquote →", err)
+	}
+
+	return s
+}
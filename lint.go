@@ -0,0 +1,99 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Lint rule identifiers.
+const (
+	LintTrailingSpace = "trailing-whitespace" // Whitespace before the end of a line
+	LintIndent        = "indent"              // Indentation mixing tabs and spaces, within a line or across the file
+	LintEmptyEquals   = "empty-equals"        // A name followed by '=' and no value, as in k=
+)
+
+// LintIssue is a style problem found on a line of a cfg file.
+type LintIssue struct {
+	Line    uint64 // Line number, starting at 1
+	Rule    string // One of the Lint rule identifiers
+	Message string
+}
+
+// Lint reports style problems in the cfg file read from 'r' without parsing it into a Cfg.
+// Reading stops at the first read error.
+func Lint(r io.Reader) []LintIssue {
+	var out []LintIssue
+	br := bufio.NewReader(r)
+	var indent rune // Indentation character of the first indented line
+
+	for ln := uint64(1); ; ln++ {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			break
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+
+		issue := func(rule, msg string) {
+			out = append(out, LintIssue{Line: ln, Rule: rule, Message: msg})
+		}
+
+		if trimmed := strings.TrimRightFunc(line, unicode.IsSpace); len(trimmed) < len(line) {
+			issue(LintTrailingSpace, "trailing whitespace")
+		}
+
+		lead := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		switch {
+		case strings.Contains(lead, " ") && strings.Contains(lead, "\t"):
+			issue(LintIndent, "indentation mixes tabs and spaces")
+
+		case lead != "" && indent == 0:
+			indent = rune(lead[0])
+
+		case lead != "" && rune(lead[0]) != indent:
+			issue(LintIndent, "indentation differs from the first indented line")
+		}
+
+		if i := commentIndex(line, DefaultOptions()); i >= 0 {
+			line = line[:i]
+		}
+		if emptyEquals(line) {
+			issue(LintEmptyEquals, "'=' without a value")
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return out
+}
+
+// Whether an unquoted '=' in 'line' is followed by whitespace or the end of the line
+func emptyEquals(line string) bool {
+	var quote rune
+	eq := false
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case eq && unicode.IsSpace(r):
+			return true
+		case r == '\'' || r == '"':
+			quote = r
+		}
+
+		eq = quote == 0 && r == '='
+	}
+
+	return eq
+}
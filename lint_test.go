@@ -0,0 +1,45 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestLint checks if each rule is reported on the expected lines
+func TestLint(t *testing.T) {
+	in := strings.Join([]string{
+		"sys=a ip=1 ",           // 1: trailing whitespace
+		"\tport=22",             // 2: sets tab indentation
+		"  dns=8.8.8.8",         // 3: spaces after tabs
+		" \tauth=x",             // 4: mixed within the line
+		"sys=b key= other='='",  // 5: empty equals, but not the quoted one
+		"sys=c empty=\"\" # k=", // 6: quoted empty and comments are fine
+		"sys=d last=",           // 7: empty equals at the end of input
+	}, "\r\n")
+
+	type found struct {
+		line uint64
+		rule string
+	}
+	ex := []found{
+		{1, LintTrailingSpace},
+		{3, LintIndent},
+		{4, LintIndent},
+		{5, LintEmptyEquals},
+		{7, LintEmptyEquals},
+	}
+
+	issues := Lint(strings.NewReader(in))
+	if len(issues) != len(ex) {
+		t.Fatal("expected", len(ex), "issues, got", len(issues), issues)
+	}
+
+	for i, issue := range issues {
+		if issue.Line != ex[i].line || issue.Rule != ex[i].rule {
+			t.Error("issue", i, "wanted", ex[i], "got", issue)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Errors is a set of errors, such as every failing field of a struct.
+type Errors []error
+
+func (e Errors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Unmarshal populates the struct pointed to by 'v' from the cfg file in 'data'.
+//
+// Fields are matched by their `cfg:"name"` tag, or their field name if untagged, as for Record.Unmarshal.
+// A struct field is decoded from the first record keyed by its name, and a slice of structs from every such record.
+// Within a record, struct fields are decoded in turn from the record's tuples keyed by their name.
+// Other fields take the values of their name in the first record, unless a struct field claims its key,
+// then in the other records keyed by it.
+// So both name=alice age=26 and a record per name decode into Name and Age, and force sets a bool field named force.
+// Names without a matching field are ignored.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("unmarshal target must be a non-nil pointer to a struct")
+	}
+
+	c, err := Load(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	// Names decoded from records of their own
+	structs := make(map[string]bool)
+	eachField(rv.Elem(), func(name string, fv reflect.Value) error {
+		structs[name] = isStruct(fv.Type()) || isStructs(fv.Type())
+		return nil
+	})
+
+	// Values of each name from the first record unless it encodes a struct, then from the other records keyed by it
+	values := make(map[string][]string)
+	if len(c.Records) > 0 && len(c.Records[0].Tuples) > 0 && !structs[c.Records[0].PrimaryKey()] {
+		values = attrValues(c.Records[0].Tuples)
+	}
+	for i, r := range c.Records {
+		if i == 0 || len(r.Tuples) < 1 {
+			continue
+		}
+
+		k := r.PrimaryKey()
+		vals, ok := attrValues(r.Tuples)[k]
+		if !ok {
+			continue
+		}
+		values[k] = append(append([]string{}, values[k]...), vals...)
+	}
+
+	records := func(name string) []Tuples {
+		var out []Tuples
+		for _, r := range c.Records {
+			if len(r.Tuples) > 0 && r.PrimaryKey() == name {
+				out = append(out, r.Tuples)
+			}
+		}
+		return out
+	}
+
+	return decodeStruct(values, records, rv.Elem())
+}
+
+// Marshal returns the cfg encoding of the struct 'v', which Unmarshal decodes back into an equal struct.
+//
+// Each field is encoded as a record keyed by its name, a slice of structs as a record per element.
+// The fields of a struct are encoded as the head tuple of its record, which is keyed by the field of the same name if any.
+// Struct fields within those are encoded as tuples of the record, and can nest no further.
+// A true bool is a valueless name and a false bool is omitted, as are empty slices.
+func Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, errors.New("marshal source must be a struct or a pointer to one")
+	}
+
+	var c Cfg
+	err := eachField(rv, func(name string, fv reflect.Value) error {
+		switch {
+		case isStruct(fv.Type()):
+			r, err := encodeRecord(name, fv)
+			c.Records = append(c.Records, r)
+			return err
+
+		case isStructs(fv.Type()):
+			for i := 0; i < fv.Len(); i++ {
+				r, err := encodeRecord(name, fv.Index(i))
+				if err != nil {
+					return err
+				}
+				c.Records = append(c.Records, r)
+			}
+			return nil
+		}
+
+		attrs, err := encodeScalars(name, fv)
+		if len(attrs) > 0 {
+			c.Records = append(c.Records, &Record{Tuples: Tuples{{Attributes: attrs}}})
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(c.String()), nil
+}
+
+// Unmarshal populates the struct pointed to by 'v' from the record's attributes.
+//
+// Fields are matched to attribute names by their `cfg:"name"` tag, or their field name if untagged.
+// A tag of `cfg:"-"` skips the field and `cfg:"name,required"` requires the name be present.
+// Slice fields collect every value of a repeated name, bool fields are true if a valueless name is present.
+// Struct fields are decoded from the first tuple keyed by their name, and slices of structs from every such tuple.
+//
+// Fields may be validated with a `validate:"..."` tag of comma-separated rules:
+// min=N and max=N bound numbers, or the length of strings and slices, and nonempty rejects empty values.
+// Every failing field is reported in the returned Errors.
+func (r *Record) Unmarshal(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("unmarshal target must be a non-nil pointer to a struct")
+	}
+
+	return decodeStruct(attrValues(r.Tuples), tupleGroups(r.Tuples), rv.Elem())
+}
+
+// Decode named values into the fields of struct 'sv', struct fields are decoded from the tuple groups of their name
+func decodeStruct(values map[string][]string, groups func(name string) []Tuples, sv reflect.Value) error {
+	var errs Errors
+	st := sv.Type()
+
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts := parseTag(f)
+		if name == "-" {
+			continue
+		}
+
+		fv := sv.Field(i)
+		if isStruct(f.Type) || isStructs(f.Type) {
+			gs := groups(name)
+			if len(gs) < 1 {
+				if opts["required"] {
+					errs = append(errs, fmt.Errorf("field %s: required name %q is missing", f.Name, name))
+				}
+				continue
+			}
+
+			if err := setStructs(fv, gs); err != nil {
+				errs = append(errs, fmt.Errorf("field %s: %v", f.Name, err))
+			}
+			continue
+		}
+
+		vals, ok := values[name]
+		if !ok {
+			if opts["required"] {
+				errs = append(errs, fmt.Errorf("field %s: required name %q is missing", f.Name, name))
+			}
+			continue
+		}
+
+		if err := setField(fv, vals); err != nil {
+			errs = append(errs, fmt.Errorf("field %s: %v", f.Name, err))
+			continue
+		}
+
+		if rules, ok := f.Tag.Lookup("validate"); ok {
+			for _, err := range validate(fv, rules) {
+				errs = append(errs, fmt.Errorf("field %s: %v", f.Name, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// Decode a struct, or a slice of structs, field from groups of tuples
+func setStructs(fv reflect.Value, groups []Tuples) error {
+	if fv.Kind() == reflect.Struct {
+		return decodeStruct(attrValues(groups[0]), tupleGroups(groups[0]), fv)
+	}
+
+	out := reflect.MakeSlice(fv.Type(), len(groups), len(groups))
+	for i, g := range groups {
+		if err := decodeStruct(attrValues(g), tupleGroups(g), out.Index(i)); err != nil {
+			return err
+		}
+	}
+	fv.Set(out)
+
+	return nil
+}
+
+// Each tuple of 'tuples' keyed by a name, as a group of its own
+func tupleGroups(tuples Tuples) func(name string) []Tuples {
+	return func(name string) []Tuples {
+		var out []Tuples
+		for _, t := range tuples {
+			if len(t.Attributes) > 0 && t.PrimaryKey() == name {
+				out = append(out, Tuples{t})
+			}
+		}
+		return out
+	}
+}
+
+// Whether a field of type 't' is a struct
+func isStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct
+}
+
+// Whether a field of type 't' is a slice of structs
+func isStructs(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct
+}
+
+// Call 'fn' with the name and value of each encodable field of struct 'sv', stopping at the first error
+func eachField(sv reflect.Value, fn func(name string, fv reflect.Value) error) error {
+	st := sv.Type()
+
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, _ := parseTag(f)
+		if name == "-" {
+			continue
+		}
+
+		if err := fn(name, sv.Field(i)); err != nil {
+			return fmt.Errorf("field %s: %v", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Encode struct 'sv' as a record keyed 'name', its struct fields as tuples
+func encodeRecord(name string, sv reflect.Value) (*Record, error) {
+	var head Attributes
+	var body Tuples
+
+	err := eachField(sv, func(n string, fv reflect.Value) error {
+		switch {
+		case isStruct(fv.Type()):
+			t, err := encodeTuple(n, fv)
+			body = append(body, t)
+			return err
+
+		case isStructs(fv.Type()):
+			for i := 0; i < fv.Len(); i++ {
+				t, err := encodeTuple(n, fv.Index(i))
+				if err != nil {
+					return err
+				}
+				body = append(body, t)
+			}
+			return nil
+		}
+
+		attrs, err := encodeScalars(n, fv)
+		head = append(head, attrs...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Record{Tuples: append(Tuples{{Attributes: keyed(name, head)}}, body...)}
+	return r, nil
+}
+
+// Encode struct 'sv' as a tuple keyed 'name'
+func encodeTuple(name string, sv reflect.Value) (*Tuple, error) {
+	var attrs Attributes
+
+	err := eachField(sv, func(n string, fv reflect.Value) error {
+		if isStruct(fv.Type()) || isStructs(fv.Type()) {
+			return errors.New("structs nest no deeper than the tuples of a record")
+		}
+
+		as, err := encodeScalars(n, fv)
+		attrs = append(attrs, as...)
+		return err
+	})
+
+	return &Tuple{Attributes: keyed(name, attrs)}, err
+}
+
+// Put the first attribute named 'name' first, or a valueless 'name' if there is none
+func keyed(name string, attrs Attributes) Attributes {
+	for i, a := range attrs {
+		if a.Name == name {
+			rest := append(append(Attributes{}, attrs[:i]...), attrs[i+1:]...)
+			return append(Attributes{a}, rest...)
+		}
+	}
+
+	return append(Attributes{{Name: name}}, attrs...)
+}
+
+// Encode a scalar or slice of scalars field as attributes named 'name'
+func encodeScalars(name string, fv reflect.Value) (Attributes, error) {
+	if fv.Kind() == reflect.Slice {
+		var out Attributes
+		for i := 0; i < fv.Len(); i++ {
+			s, err := formatScalar(fv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, &Attribute{Name: name, Value: s, Assigned: true})
+		}
+		return out, nil
+	}
+
+	if fv.Kind() == reflect.Bool {
+		// Flags are present or absent
+		if fv.Bool() {
+			return Attributes{{Name: name}}, nil
+		}
+		return nil, nil
+	}
+
+	s, err := formatScalar(fv)
+	if err != nil {
+		return nil, err
+	}
+
+	return Attributes{{Name: name, Value: s, Assigned: true}}, nil
+}
+
+// Format a scalar value as setScalar parses it
+func formatScalar(fv reflect.Value) (string, error) {
+	switch fv.Kind() {
+	case reflect.String:
+		return fv.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(fv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(fv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(fv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(fv.Float(), 'g', -1, fv.Type().Bits()), nil
+	}
+
+	return "", errors.New("unsupported field type " + fv.Type().String())
+}
+
+// Name and options of a struct field's cfg tag
+func parseTag(f reflect.StructField) (string, map[string]bool) {
+	opts := make(map[string]bool)
+
+	tag, ok := f.Tag.Lookup("cfg")
+	if !ok {
+		return f.Name, opts
+	}
+
+	parts := strings.Split(tag, ",")
+	for _, o := range parts[1:] {
+		opts[o] = true
+	}
+
+	if parts[0] == "" {
+		return f.Name, opts
+	}
+
+	return parts[0], opts
+}
+
+// All values of each name in order, valueless names map to an empty list
+func attrValues(tuples Tuples) map[string][]string {
+	out := make(map[string][]string)
+
+	for _, t := range tuples {
+		for _, a := range t.Attributes {
+			if a.Value != "" {
+				out[a.Name] = append(out[a.Name], a.Value)
+			} else if _, ok := out[a.Name]; !ok {
+				// Omitted value
+				out[a.Name] = []string{}
+			}
+		}
+	}
+
+	return out
+}
+
+// Set a field from the values of a name which is present
+func setField(fv reflect.Value, vals []string) error {
+	if fv.Kind() == reflect.Slice {
+		out := reflect.MakeSlice(fv.Type(), len(vals), len(vals))
+		for i, s := range vals {
+			if err := setScalar(out.Index(i), s, true); err != nil {
+				return err
+			}
+		}
+		fv.Set(out)
+		return nil
+	}
+
+	if len(vals) < 1 {
+		// Valueless name, only meaningful for flags
+		return setScalar(fv, "", false)
+	}
+
+	return setScalar(fv, vals[0], true)
+}
+
+// Set a scalar field from a single value, 'valued' is false for valueless names
+func setScalar(fv reflect.Value, s string, valued bool) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+
+	case reflect.Bool:
+		if !valued {
+			fv.SetBool(true)
+			return nil
+		}
+
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !valued {
+			return nil
+		}
+
+		n, err := strconv.ParseInt(s, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !valued {
+			return nil
+		}
+
+		n, err := strconv.ParseUint(s, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		if !valued {
+			return nil
+		}
+
+		n, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+
+	default:
+		return errors.New("unsupported field type " + fv.Type().String())
+	}
+
+	return nil
+}
+
+// Check a decoded field against comma-separated validation rules
+func validate(fv reflect.Value, rules string) []error {
+	var errs []error
+
+	for _, rule := range strings.Split(rules, ",") {
+		op, arg, _ := strings.Cut(rule, "=")
+
+		switch op {
+		case "":
+			continue
+
+		case "nonempty":
+			if size(fv) == 0 {
+				errs = append(errs, errors.New("must not be empty"))
+			}
+
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s bound %q", op, arg))
+				continue
+			}
+
+			n := size(fv)
+			if op == "min" && n < bound {
+				errs = append(errs, fmt.Errorf("%v is less than min %v", n, bound))
+			}
+			if op == "max" && n > bound {
+				errs = append(errs, fmt.Errorf("%v is greater than max %v", n, bound))
+			}
+
+		default:
+			errs = append(errs, fmt.Errorf("unknown validation rule %q", op))
+		}
+	}
+
+	return errs
+}
+
+// Numeric value of a number, or the length of a string or slice
+func size(fv reflect.Value) float64 {
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(fv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(fv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return fv.Float()
+	case reflect.String, reflect.Slice:
+		return float64(fv.Len())
+	case reflect.Bool:
+		if fv.Bool() {
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestRecordUnmarshal checks if a record decodes into a struct
+func TestRecordUnmarshal(t *testing.T) {
+	type service struct {
+		Name    string   `cfg:"service,required"`
+		Port    int      `cfg:"port,required" validate:"min=1,max=65535"`
+		DNS     []string `cfg:"dns"`
+		Debug   bool     `cfg:"debug"`
+		Ignored string   `cfg:"-"`
+	}
+
+	r, err := ParseRecord("service=web port=8080 debug\n\tdns=1.1.1.1\n\tdns=8.8.8.8\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	var s service
+	if err := r.Unmarshal(&s); err != nil {
+		t.Fatal("could not unmarshal →", err)
+	}
+
+	if s.Name != "web" || s.Port != 8080 || !s.Debug {
+		t.Error("incorrect scalar fields:", s)
+	}
+
+	if len(s.DNS) != 2 || s.DNS[0] != "1.1.1.1" || s.DNS[1] != "8.8.8.8" {
+		t.Error("incorrect slice field:", s.DNS)
+	}
+}
+
+// TestRecordValidate checks if every failing field is reported
+func TestRecordValidate(t *testing.T) {
+	type service struct {
+		Name  string `cfg:"service" validate:"nonempty"`
+		Port  int    `cfg:"port" validate:"min=1,max=65535"`
+		Owner string `cfg:"owner,required"`
+	}
+
+	r, err := ParseRecord("service= port=70000 owner=alice\n")
+	if err != nil {
+		t.Fatal("could not parse →", err)
+	}
+
+	var s service
+	err = r.Unmarshal(&s)
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatal("expected Errors, got:", err)
+	}
+
+	if len(errs) != 2 {
+		t.Fatal("expected two failing fields, got:", errs)
+	}
+
+	if !strings.Contains(errs[0].Error(), "Name") || !strings.Contains(errs[1].Error(), "Port") {
+		t.Error("incorrect failing fields reported:", errs)
+	}
+}
+
+// Structure of the test file, as far as it is decoded
+type testDoc struct {
+	A     string  `cfg:"a"`
+	C     string  `cfg:"c"`
+	IPNet ipnet   `cfg:"ipnet"`
+	Names []named `cfg:"name"`
+	Force bool    `cfg:"force"`
+	Other bool    `cfg:"missing"`
+}
+
+type ipnet struct {
+	Name    string   `cfg:"ipnet"`
+	IP      string   `cfg:"ip"`
+	Mask    string   `cfg:"ipmask"`
+	Gateway string   `cfg:"ipgw"`
+	DNS     []string `cfg:"dns"`
+	Auth    auth     `cfg:"auth"`
+}
+
+type auth struct {
+	Server string `cfg:"auth"`
+	Domain string `cfg:"authdom"`
+}
+
+type named struct {
+	Name string `cfg:"name"`
+	Age  int    `cfg:"age"`
+}
+
+// TestUnmarshal checks if the test file decodes into nested structs
+func TestUnmarshal(t *testing.T) {
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatal("could not read", testFile, "→", err)
+	}
+
+	var doc testDoc
+	if err := Unmarshal(data, &doc); err != nil {
+		t.Fatal("could not unmarshal →", err)
+	}
+
+	ex := testDoc{
+		A: "b",
+		C: "d",
+		IPNet: ipnet{
+			Name:    "house",
+			IP:      "1.2.3.0",
+			Mask:    "255.255.255.0",
+			Gateway: "1.2.3.1",
+			DNS:     []string{"5.6.7.8"},
+			Auth:    auth{Server: "1.2.3.4", Domain: "HOME"},
+		},
+		Names: []named{{Name: "alice", Age: 26}},
+		Force: true,
+	}
+
+	if !reflect.DeepEqual(doc, ex) {
+		t.Error("incorrect decoding, wanted", ex, "got", doc)
+	}
+}
+
+// TestMarshal checks if structs encode to a cfg which decodes back to them
+func TestMarshal(t *testing.T) {
+	doc := testDoc{
+		A: "hello there",
+		IPNet: ipnet{
+			Name: "house",
+			IP:   "1.2.3.0",
+			DNS:  []string{"5.6.7.8", "5.6.7.9"},
+			Auth: auth{Server: "1.2.3.4", Domain: "HOME"},
+		},
+		Names: []named{{Name: "alice", Age: 26}, {Name: "bob", Age: 30}},
+		Force: true,
+	}
+
+	data, err := Marshal(&doc)
+	if err != nil {
+		t.Fatal("could not marshal →", err)
+	}
+
+	ex := `a="hello there" 
+c= 
+ipnet=house ip=1.2.3.0 ipmask= ipgw= dns=5.6.7.8 dns=5.6.7.9 
+	auth=1.2.3.4 authdom=HOME 
+name=alice age=26 
+name=bob age=30 
+force= 
+`
+	if string(data) != ex {
+		t.Error("incorrect encoding, wanted:", ex, "got:", data)
+	}
+
+	var back testDoc
+	if err := Unmarshal(data, &back); err != nil {
+		t.Fatal("could not unmarshal →", err)
+	}
+
+	if !reflect.DeepEqual(doc, back) {
+		t.Error("round trip differs, wanted", doc, "got", back)
+	}
+
+	// A leading struct record doesn't fill top-level scalars
+	type shared struct {
+		Auth struct {
+			User string `cfg:"user"`
+		} `cfg:"auth"`
+		User string `cfg:"user"`
+	}
+	var sh shared
+	sh.Auth.User = "x"
+	sh.User = "y"
+
+	data, err = Marshal(sh)
+	if err != nil {
+		t.Fatal("could not marshal →", err)
+	}
+
+	var shBack shared
+	if err := Unmarshal(data, &shBack); err != nil {
+		t.Fatal("could not unmarshal →", err)
+	}
+	if shBack != sh {
+		t.Error("round trip differs through:", data, "wanted", sh, "got", shBack)
+	}
+
+	type tooDeep struct {
+		R struct {
+			T struct {
+				Deeper auth
+			}
+		}
+	}
+	if _, err := Marshal(tooDeep{}); err == nil {
+		t.Error("expected an error for structs nested too deeply")
+	}
+}
+
+// TestMarshalValues checks if values needing quotes survive a round trip
+func TestMarshalValues(t *testing.T) {
+	type values struct {
+		Name string   `cfg:"name"`
+		Vals []string `cfg:"val"`
+	}
+
+	doc := values{
+		Name: "it's",
+		Vals: []string{`"leading`, "=x", "a=b", " space", `both ' and "`, "#hash"},
+	}
+
+	data, err := Marshal(doc)
+	if err != nil {
+		t.Fatal("could not marshal →", err)
+	}
+
+	var back values
+	if err := Unmarshal(data, &back); err != nil {
+		t.Fatal("could not unmarshal", string(data), "→", err)
+	}
+
+	if !reflect.DeepEqual(doc, back) {
+		t.Error("round trip differs through:", data, "wanted", doc, "got", back)
+	}
+
+	// Scalars in a single leading record
+	var one named
+	if err := Unmarshal([]byte("name=alice age=26\n"), &one); err != nil {
+		t.Fatal("could not unmarshal →", err)
+	}
+
+	if one.Name != "alice" || one.Age != 26 {
+		t.Error("incorrect decoding of the first record:", one)
+	}
+}
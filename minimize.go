@@ -0,0 +1,76 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Minimize reduces 'input' which fails to Load to a smaller set of its lines failing with the same class of error.
+// Errors are of the same class if their messages match apart from their position.
+// Lines are removed by delta debugging, so the result is minimal in that removing any single line makes it load or fail differently.
+// Input which loads is returned unchanged.
+func Minimize(input []byte) []byte {
+	class := loadErrorClass(input)
+	if class == "" {
+		return input
+	}
+
+	lines := bytes.SplitAfter(input, []byte("\n"))
+	fails := func(lines [][]byte) bool {
+		return loadErrorClass(bytes.Join(lines, nil)) == class
+	}
+
+	// Try removing each of n chunks, refining until chunks are single lines
+	for n := 2; len(lines) > 1; {
+		size := (len(lines) + n - 1) / n
+		reduced := false
+
+		for start := 0; start < len(lines); start += size {
+			end := start + size
+			if end > len(lines) {
+				end = len(lines)
+			}
+
+			rest := append(append([][]byte{}, lines[:start]...), lines[end:]...)
+			if len(rest) > 0 && fails(rest) {
+				lines = rest
+				reduced = true
+				break
+			}
+		}
+
+		switch {
+		case reduced:
+			if n > 2 {
+				n--
+			}
+		case size == 1:
+			return bytes.Join(lines, nil)
+		default:
+			n *= 2
+			if n > len(lines) {
+				n = len(lines)
+			}
+		}
+	}
+
+	return bytes.Join(lines, nil)
+}
+
+// The error message of loading 'input' without its position, or "" if it loads
+func loadErrorClass(input []byte) string {
+	_, err := Load(bytes.NewReader(input))
+	if err == nil {
+		return ""
+	}
+
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		return pe.Msg
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2021, Microsoft Corporation, Sean Hinchee
+// Licensed under the MIT License.
+
+package cfg
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMinimize checks if a failing file is reduced to its bad line
+func TestMinimize(t *testing.T) {
+	in := strings.Join([]string{
+		"sys=a ip=1",
+		"\tport=22",
+		"sys=b ip=2",
+		"\tauth='unterminated",
+		"sys=c ip=3",
+		"\tport=80",
+		"",
+	}, "\n")
+
+	if out := string(Minimize([]byte(in))); out != "\tauth='unterminated\n" {
+		t.Error("incorrect reduction →", out)
+	}
+
+	good := []byte("sys=a\n")
+	if out := Minimize(good); string(out) != string(good) {
+		t.Error("valid input was changed →", out)
+	}
+}